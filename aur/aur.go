@@ -2,41 +2,113 @@
 package aur
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	urlBase = "https://aur.archlinux.org"
+	// DefaultURL is the base url of the official AUR.
+	DefaultURL = "https://aur.archlinux.org"
+
+	// DefaultTimeout is the overall timeout used by DefaultClient for
+	// a single request.
+	DefaultTimeout = 60 * time.Second
 
 	// Used to put together info requests for batches of names
 	namePrefix    = "&arg[]="
 	namePrefixLen = len(namePrefix)
 )
 
+// DefaultClient is the Client used by the package-level functions.
+var DefaultClient = NewClient(DefaultURL, DefaultTimeout)
+
+// Client talks to an AUR instance.  The zero value is not useful;
+// use NewClient.
+type Client struct {
+	// BaseURL is the root of the AUR instance, without a trailing
+	// slash, e.g. https://aur.archlinux.org
+	BaseURL string
+	// HTTPClient is used for every request.  If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// UserAgent is sent with every request, if non-empty.
+	UserAgent string
+}
+
+// NewClient returns a Client that talks to baseURL.  A timeout of 0
+// means no timeout.
+func NewClient(baseURL string, timeout time.Duration) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: timeout},
+		UserAgent:  "poltroon",
+	}
+}
+
 // PkgInfo contains information about an AUR package.
 type PkgInfo struct {
 	Name        string
+	PackageBase string
 	Version     string
+	Description string
+	// URL is the upstream project url.
+	URL         string
 	SnapshotURL string
+
+	// Maintainer is empty for orphaned packages.
+	Maintainer string
+	// OutOfDate is the time the package was flagged out of date, or
+	// the zero time if it isn't flagged.
+	OutOfDate      time.Time
+	FirstSubmitted time.Time
+	LastModified   time.Time
+	NumVotes       int
+	Popularity     float64
+
+	License      []string
+	Depends      []string
+	MakeDepends  []string
+	CheckDepends []string
+	OptDepends   []string
+	Provides     []string
+	Conflicts    []string
+	Replaces     []string
+	Keywords     []string
+}
+
+// IsOrphan returns true if nobody maintains the package.
+func (p *PkgInfo) IsOrphan() bool {
+	return p.Maintainer == ""
+}
+
+// IsOutOfDate returns true if the package has been flagged out of date.
+func (p *PkgInfo) IsOutOfDate() bool {
+	return !p.OutOfDate.IsZero()
+}
+
+// GetInfos calls DefaultClient.GetInfos.
+func GetInfos(ctx context.Context, allNames []string) (map[string]*PkgInfo, error) {
+	return DefaultClient.GetInfos(ctx, allNames)
 }
 
 // GetInfos queries the AUR for every name in allNames.  The result
 // map will not contain an entry for every input if the AUR didn't
 // return anything for the package.  Perhaps this happens if the
 // package has been removed?  If an error is returned, we just return
-// that one error.
-func GetInfos(allNames []string) (map[string]*PkgInfo, error) {
+// that one error.  Cancelling ctx abandons any request in flight.
+func (c *Client) GetInfos(ctx context.Context, allNames []string) (map[string]*PkgInfo, error) {
 	result := map[string]*PkgInfo{}
 	nameBatches := escapeAndBatch(1024, allNames)
 	for i, names := range nameBatches {
-		infoBatch, err := fetch(names)
+		infoBatch, err := c.fetch(ctx, names)
 		if err != nil {
 			return result, errors.Wrapf(err, "Fetching batch %d with %d entries", i, len(names))
 		}
@@ -47,6 +119,37 @@ func GetInfos(allNames []string) (map[string]*PkgInfo, error) {
 	return result, nil
 }
 
+// Get performs a GET request for rawurl, which may be absolute or
+// relative to BaseURL.  A non-200 status is treated as an error.  The
+// caller must close the response body.  Cancelling ctx abandons the
+// request, including reading the body.
+func (c *Client) Get(ctx context.Context, rawurl string) (*http.Response, error) {
+	if strings.HasPrefix(rawurl, "/") {
+		rawurl = c.BaseURL + rawurl
+	}
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating request for %s", rawurl)
+	}
+	req = req.WithContext(ctx)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %s", rawurl)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("get %s: unexpected status %d/%s", rawurl, resp.StatusCode, resp.Status)
+	}
+	return resp, nil
+}
+
 // breaks a single slice of names into a slice of slices, based on
 // size of escaped name.  Escapes the names as part of this process.,
 // attempting to keep each batch below maxSize (if one name would go
@@ -72,54 +175,109 @@ func escapeAndBatch(maxSize int, allNames []string) [][]string {
 	return result
 }
 
-func fetch(names []string) ([]*PkgInfo, error) {
+func (c *Client) fetch(ctx context.Context, names []string) ([]*PkgInfo, error) {
 	argString := namePrefix + strings.Join(names, namePrefix)
 	query := fmt.Sprintf("v=5&type=info%s", argString)
-	url := fmt.Sprintf("%s/rpc/?%s", urlBase, query)
-	resp, err := http.Get(url)
+	resp, err := c.Get(ctx, "/rpc/?"+query)
 	if err != nil {
-		return nil, errors.Wrapf(err, "fetch get for %v", names)
+		return nil, errors.Wrapf(err, "fetch for %v", names)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("fetch got unexpected status %d/%s for %v", resp.StatusCode, resp.Status, names)
-	}
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, errors.Wrapf(err, "fetch readbody for %v", names)
 	}
-	return decodeResults(data)
+	return decodeResults(c.BaseURL, data)
 
 }
 
-func decodeResults(data []byte) ([]*PkgInfo, error) {
+func decodeResults(baseURL string, data []byte) ([]*PkgInfo, error) {
 	result := []*PkgInfo{}
 	var response infoResponse
 	if err := json.Unmarshal(data, &response); err != nil {
 		return result, errors.Wrapf(err, "unmarshal %s", string(data))
 	}
+	if response.Type == "error" {
+		return result, errors.Errorf("aur returned error: %s", response.Error)
+	}
 
 	for _, r := range response.Results {
-		result = append(result, r.makePkgInfo())
+		result = append(result, r.makePkgInfo(baseURL))
 	}
 	return result, nil
 }
 
-// Used to decode json rpc response for GetVersion call.
+// Used to decode json rpc response for info and search calls.
 type infoResponse struct {
 	Version     int
 	Type        string
 	ResultCount int
 	Results     []infoResult
+	Error       string
 }
 
-// Used to decode result portion of json response.
+// Used to decode result portion of json response.  Fields that can
+// be null are pointers.
 type infoResult struct {
-	Name    string
-	Version string
-	URLPath string
+	Name           string
+	PackageBase    string
+	Version        string
+	Description    *string
+	URL            *string
+	URLPath        string
+	Maintainer     *string
+	OutOfDate      *int64
+	FirstSubmitted int64
+	LastModified   int64
+	NumVotes       int
+	Popularity     float64
+	License        []string
+	Depends        []string
+	MakeDepends    []string
+	CheckDepends   []string
+	OptDepends     []string
+	Provides       []string
+	Conflicts      []string
+	Replaces       []string
+	Keywords       []string
+}
+
+func (r infoResult) makePkgInfo(baseURL string) *PkgInfo {
+	return &PkgInfo{
+		Name:           r.Name,
+		PackageBase:    r.PackageBase,
+		Version:        r.Version,
+		Description:    stringOrEmpty(r.Description),
+		URL:            stringOrEmpty(r.URL),
+		SnapshotURL:    baseURL + r.URLPath,
+		Maintainer:     stringOrEmpty(r.Maintainer),
+		OutOfDate:      unixOrZero(r.OutOfDate),
+		FirstSubmitted: unixOrZero(&r.FirstSubmitted),
+		LastModified:   unixOrZero(&r.LastModified),
+		NumVotes:       r.NumVotes,
+		Popularity:     r.Popularity,
+		License:        r.License,
+		Depends:        r.Depends,
+		MakeDepends:    r.MakeDepends,
+		CheckDepends:   r.CheckDepends,
+		OptDepends:     r.OptDepends,
+		Provides:       r.Provides,
+		Conflicts:      r.Conflicts,
+		Replaces:       r.Replaces,
+		Keywords:       r.Keywords,
+	}
 }
 
-func (r infoResult) makePkgInfo() *PkgInfo {
-	return &PkgInfo{r.Name, r.Version, urlBase + r.URLPath}
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func unixOrZero(secs *int64) time.Time {
+	if secs == nil || *secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(*secs, 0).UTC()
 }
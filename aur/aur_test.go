@@ -1,11 +1,15 @@
 package aur
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func TestBatch(t *testing.T) {
@@ -64,6 +68,99 @@ func TestBatch(t *testing.T) {
 	}
 }
 
+func TestClientGetInfos(t *testing.T) {
+	var gotAgent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAgent = r.Header.Get("User-Agent")
+		equals(t, "/rpc/", r.URL.Path)
+		equals(t, []string{"foo", "bar"}, r.URL.Query()["arg[]"])
+		fmt.Fprint(w, `{"version":5,"type":"multiinfo","resultcount":1,"results":[
+			{"Name":"foo","Version":"1.2-1","URLPath":"/cgit/aur.git/snapshot/foo.tar.gz"}]}`)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL+"/", 0)
+	c.UserAgent = "tester"
+	infos, err := c.GetInfos(context.Background(), []string{"foo", "bar"})
+	ok(t, err)
+	equals(t, "tester", gotAgent)
+	equals(t, map[string]*PkgInfo{
+		"foo": &PkgInfo{
+			Name:        "foo",
+			Version:     "1.2-1",
+			SnapshotURL: ts.URL + "/cgit/aur.git/snapshot/foo.tar.gz",
+		},
+	}, infos)
+}
+
+func TestDecodeResults(t *testing.T) {
+	data := []byte(`{"version":5,"type":"multiinfo","resultcount":2,"results":[
+		{"ID":1,"Name":"foo-git","PackageBaseID":2,"PackageBase":"foo","Version":"r10.abc-1",
+		 "Description":"A foo","URL":"https://example.com/foo","NumVotes":12,"Popularity":0.5,
+		 "OutOfDate":1500000000,"Maintainer":"gina","FirstSubmitted":1400000000,
+		 "LastModified":1450000000,"URLPath":"/cgit/aur.git/snapshot/foo.tar.gz",
+		 "Depends":["glibc","bar>=2"],"MakeDepends":["git"],"CheckDepends":["check"],
+		 "OptDepends":["baz: for baz support"],"Provides":["foo"],"Conflicts":["foo"],
+		 "Replaces":["oldfoo"],"License":["MIT"],"Keywords":["fooing"]},
+		{"Name":"orphan","PackageBase":"orphan","Version":"1-1","Description":null,
+		 "URL":null,"Maintainer":null,"OutOfDate":null,"URLPath":"/o.tar.gz"}]}`)
+	infos, err := decodeResults("https://aur", data)
+	ok(t, err)
+	equals(t, 2, len(infos))
+
+	equals(t, &PkgInfo{
+		Name:           "foo-git",
+		PackageBase:    "foo",
+		Version:        "r10.abc-1",
+		Description:    "A foo",
+		URL:            "https://example.com/foo",
+		SnapshotURL:    "https://aur/cgit/aur.git/snapshot/foo.tar.gz",
+		Maintainer:     "gina",
+		OutOfDate:      time.Unix(1500000000, 0).UTC(),
+		FirstSubmitted: time.Unix(1400000000, 0).UTC(),
+		LastModified:   time.Unix(1450000000, 0).UTC(),
+		NumVotes:       12,
+		Popularity:     0.5,
+		License:        []string{"MIT"},
+		Depends:        []string{"glibc", "bar>=2"},
+		MakeDepends:    []string{"git"},
+		CheckDepends:   []string{"check"},
+		OptDepends:     []string{"baz: for baz support"},
+		Provides:       []string{"foo"},
+		Conflicts:      []string{"foo"},
+		Replaces:       []string{"oldfoo"},
+		Keywords:       []string{"fooing"},
+	}, infos[0])
+	assert(t, infos[0].IsOutOfDate(), "foo-git should be out of date")
+	assert(t, !infos[0].IsOrphan(), "foo-git should not be an orphan")
+
+	assert(t, !infos[1].IsOutOfDate(), "orphan should not be out of date")
+	assert(t, infos[1].IsOrphan(), "orphan should be an orphan")
+	equals(t, "", infos[1].Description)
+}
+
+func TestClientCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request should not have been sent")
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewClient(ts.URL, 0).GetInfos(ctx, []string{"foo"})
+	assert(t, err != nil, "expected an error for a cancelled context")
+}
+
+func TestClientBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	_, err := NewClient(ts.URL, 0).GetInfos(context.Background(), []string{"foo"})
+	assert(t, err != nil, "expected an error for a 503 response")
+}
+
 // assert fails the test if the condition is false.
 func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
 	if !condition {
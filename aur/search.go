@@ -0,0 +1,60 @@
+package aur
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// By controls which field a Search matches against.
+type By string
+
+// The fields the AUR knows how to search by.
+const (
+	ByName         By = "name"
+	ByNameDesc     By = "name-desc"
+	ByMaintainer   By = "maintainer"
+	ByDepends      By = "depends"
+	ByMakeDepends  By = "makedepends"
+	ByOptDepends   By = "optdepends"
+	ByCheckDepends By = "checkdepends"
+)
+
+// AllBy lists every supported By value.
+var AllBy = []By{ByName, ByNameDesc, ByMaintainer, ByDepends, ByMakeDepends, ByOptDepends, ByCheckDepends}
+
+// ParseBy converts s into a By, returning an error if it isn't one we
+// know about.
+func ParseBy(s string) (By, error) {
+	for _, b := range AllBy {
+		if string(b) == s {
+			return b, nil
+		}
+	}
+	return "", errors.Errorf("Unknown search field %q, expected one of %v", s, AllBy)
+}
+
+// Search calls DefaultClient.Search.
+func Search(ctx context.Context, term string, by By) ([]*PkgInfo, error) {
+	return DefaultClient.Search(ctx, term, by)
+}
+
+// Search asks the AUR for packages matching term, compared against
+// the by field.  Search results only carry a subset of the fields
+// GetInfos returns; in particular the dependency lists are empty.
+func (c *Client) Search(ctx context.Context, term string, by By) ([]*PkgInfo, error) {
+	query := fmt.Sprintf("v=5&type=search&by=%s&arg=%s", url.QueryEscape(string(by)), url.QueryEscape(term))
+	resp, err := c.Get(ctx, "/rpc/?"+query)
+	if err != nil {
+		return nil, errors.Wrapf(err, "search for %q by %s", term, by)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "search readbody for %q by %s", term, by)
+	}
+	return decodeResults(c.BaseURL, data)
+}
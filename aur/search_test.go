@@ -0,0 +1,45 @@
+package aur
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		equals(t, "search", q.Get("type"))
+		equals(t, "maintainer", q.Get("by"))
+		if q.Get("arg") == "a" {
+			fmt.Fprint(w, `{"version":5,"type":"error","resultcount":0,"results":[],"error":"Too many package results."}`)
+			return
+		}
+		equals(t, "gina bee", q.Get("arg"))
+		fmt.Fprint(w, `{"version":5,"type":"search","resultcount":2,"results":[
+			{"Name":"foo","Version":"1-1","NumVotes":3,"URLPath":"/foo.tar.gz"},
+			{"Name":"bar","Version":"2-1","NumVotes":5,"URLPath":"/bar.tar.gz"}]}`)
+	}))
+	defer ts.Close()
+	c := NewClient(ts.URL, 0)
+
+	infos, err := c.Search(context.Background(), "gina bee", ByMaintainer)
+	ok(t, err)
+	equals(t, 2, len(infos))
+	equals(t, "foo", infos[0].Name)
+	equals(t, 5, infos[1].NumVotes)
+
+	_, err = c.Search(context.Background(), "a", ByMaintainer)
+	assert(t, err != nil, "expected error response to become an error")
+}
+
+func TestParseBy(t *testing.T) {
+	by, err := ParseBy("name-desc")
+	ok(t, err)
+	equals(t, ByNameDesc, by)
+
+	_, err = ParseBy("bogus")
+	assert(t, err != nil, "expected an error for an unknown field")
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -12,6 +14,12 @@ import (
 type AurPackage struct {
 	// name of the package
 	Name string
+	// PackageBase is the name of the AUR git repository the package
+	// comes from.  It is only different from Name for split packages.
+	PackageBase string
+	// Members holds the names of other packages from the same
+	// PackageBase that we want, made along with this one.
+	Members []string
 	// CurrentVersion is the version of this package currently installed.
 	CurrentVersion string
 	// NextVersion is the available version of this package
@@ -19,49 +27,180 @@ type AurPackage struct {
 
 	// url to fetch the current snapshot
 	SnapshotURL string
+	// Commit is the git commit to build, when building from git.  If
+	// it is empty when we fetch, it gets set to the newest commit.
+	Commit string
+
+	// AurDepends holds the names of other AUR packages that must be
+	// built and installed before this one can be built.
+	AurDepends []string
+	// Dependency is true if this package was not asked for, but was
+	// pulled in to satisfy another package.
+	Dependency bool
+	// Devel is true for development packages, such as foo-git, that
+	// are being made because their upstream sources changed.  Their
+	// version comes from upstream, so we don't know it until they
+	// are made.
+	Devel bool
+	// Revisions maps the version control sources of the package to
+	// the upstream revision they were at when it was fetched.
+	Revisions map[string]string
 
 	// root of the package directory
 	Root string
 
 	// set after a successful make
 	PkgPaths []string
+	// Mismatches describes any ways the packages made are not what we
+	// expected, such as a different version.
+	Mismatches []string
 }
 
-// NewAurPackage creates a new AurPackage.  The next step is to call PreparePackageDir.
+// Name of the directory, next to the version directories of a
+// package, that makepkg keeps downloaded sources in.  Sources are
+// shared between versions, so that updates only download what
+// changed.
+const SourcesDir = "sources"
+
+// unversioned is used in place of the version for packages we don't
+// know the version of, such as ones made from local archives.
+const unversioned = "unversioned"
+
+// NewAurPackage creates a new AurPackage, kept in root/name/nextVersion.
+// The next step is to call PreparePackageDir.
 func NewAurPackage(root, name, currentVersion, nextVersion, snapshotURL string) *AurPackage {
+	version := nextVersion
+	if version == "" {
+		version = unversioned
+	}
 	return &AurPackage{
 		Name:           name,
 		CurrentVersion: currentVersion,
 		NextVersion:    nextVersion,
 		SnapshotURL:    snapshotURL,
-		Root:           path.Join(root, name),
+		Root:           path.Join(root, name, version),
 	}
 }
 
+// Base returns PackageBase, or Name if we don't know it.
+func (a *AurPackage) Base() string {
+	if a.PackageBase != "" {
+		return a.PackageBase
+	}
+	return a.Name
+}
+
+// Wanted returns the names of the packages we want from this
+// package's PackageBase: Name and any Members.
+func (a *AurPackage) Wanted() []string {
+	return append([]string{a.Name}, a.Members...)
+}
+
 func (a *AurPackage) String() string {
-	return fmt.Sprintf(":: %s %s -> %s", a.Name, a.CurrentVersion, a.NextVersion)
+	next := a.NextVersion
+	if a.Devel {
+		next = "newer upstream sources"
+	}
+	s := fmt.Sprintf(":: %s %s -> %s", a.Name, a.CurrentVersion, next)
+	if len(a.Members) != 0 {
+		s += fmt.Sprintf(" (with %s)", strings.Join(a.Members, ", "))
+	}
+	return s
 }
 
-// PreparePackageDir creates a package directory we can download to later.
-func (a *AurPackage) PreparePackageDir(perm os.FileMode) error {
-	if err := os.RemoveAll(a.Root); err != nil {
-		return errors.Wrapf(err, "Unable to clean %q", a.Root)
+// GroupByBase merges packages from the same PackageBase, which are
+// made together, into the first of them.  The others become Members
+// of that one.  It is meant for use before AurDepends are worked out.
+func GroupByBase(pkgs []*AurPackage) []*AurPackage {
+	var result []*AurPackage
+	byBase := map[string]*AurPackage{}
+	for _, p := range pkgs {
+		first, ok := byBase[p.Base()]
+		if !ok {
+			byBase[p.Base()] = p
+			result = append(result, p)
+			continue
+		}
+		first.Members = append(first.Members, p.Wanted()...)
+		// Asking for any of them means asking for the whole group.
+		first.Dependency = first.Dependency && p.Dependency
 	}
-	if err := os.MkdirAll(a.Logs(), perm); err != nil {
-		return err
+	return result
+}
+
+// PreparePackageDir creates a package directory we can download to
+// later.  Anything left from an earlier attempt at this version is
+// cleaned out, except for the packages it made and the downloaded
+// sources.
+func (a *AurPackage) PreparePackageDir(perm os.FileMode) error {
+	for _, d := range []string{a.Logs(), a.Reviewed(), a.Build()} {
+		if err := os.RemoveAll(d); err != nil {
+			return errors.Wrapf(err, "Unable to clean %q", d)
+		}
 	}
-	if err := os.MkdirAll(a.Build(), perm); err != nil {
-		return err
+	for _, d := range []string{a.Logs(), a.Build(), a.Packages(), a.Sources()} {
+		if err := os.MkdirAll(d, perm); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Made returns the package files made by an earlier run for this
+// version, or nil if there are none.  Signatures are left out.  For
+// Devel packages, the version doesn't say enough, so it is always
+// nil.
+func (a *AurPackage) Made() ([]string, error) {
+	if a.NextVersion == "" || a.Devel {
+		return nil, nil
+	}
+	own, err := filepath.Glob(path.Join(a.Packages(), a.Name+"-"+a.NextVersion+"-*.pkg.tar*"))
+	if err != nil || len(own) == 0 {
+		return nil, err
+	}
+	// Split packages made alongside this one belong to it too.
+	return a.PackageFiles()
+}
+
+// PackageFiles returns the package files in Packages(), leaving out
+// signatures.
+func (a *AurPackage) PackageFiles() ([]string, error) {
+	all, err := filepath.Glob(path.Join(a.Packages(), "*.pkg.tar*"))
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, m := range all {
+		if !strings.HasSuffix(m, ".sig") {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
 // Logs returns the the directory where we should put log files.
 func (a *AurPackage) Logs() string {
 	return path.Join(a.Root, "logs")
 }
 
+// Reviewed returns the directory holding a copy of the package files
+// as the user approved them, before makepkg adds anything.
+func (a *AurPackage) Reviewed() string {
+	return path.Join(a.Root, "reviewed")
+}
+
 // Build return the directory where we should put build files.
 func (a *AurPackage) Build() string {
 	return path.Join(a.Root, "build")
 }
+
+// Packages returns the directory makepkg should put the packages it
+// makes in.
+func (a *AurPackage) Packages() string {
+	return path.Join(a.Root, "packages")
+}
+
+// Sources returns the directory makepkg should download sources to.
+func (a *AurPackage) Sources() string {
+	return path.Join(path.Dir(a.Root), SourcesDir)
+}
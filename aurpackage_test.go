@@ -0,0 +1,73 @@
+package poltroon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPreparePackageDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "poltroon_aurpackage_test")
+	ok(t, err)
+	defer os.RemoveAll(root)
+
+	a := NewAurPackage(root, "foo", "1-1", "2-1", "")
+	equals(t, path.Join(root, "foo", "2-1"), a.Root)
+	ok(t, a.PreparePackageDir(0755))
+	made, err := a.Made()
+	ok(t, err)
+	equals(t, 0, len(made))
+
+	write := func(p string) {
+		ok(t, ioutil.WriteFile(p, nil, 0644))
+	}
+	write(path.Join(a.Build(), "PKGBUILD"))
+	write(path.Join(a.Sources(), "foo-2.tar.gz"))
+	write(path.Join(a.Packages(), "foo-2-1-x86_64.pkg.tar.zst"))
+	write(path.Join(a.Packages(), "foo-2-1-x86_64.pkg.tar.zst.sig"))
+	write(path.Join(a.Packages(), "foo-docs-2-1-any.pkg.tar.zst"))
+
+	// Going again keeps what was made and downloaded.
+	ok(t, a.PreparePackageDir(0755))
+	_, err = os.Stat(path.Join(a.Build(), "PKGBUILD"))
+	assert(t, os.IsNotExist(err), "expected the build directory to be cleaned out")
+	_, err = os.Stat(path.Join(a.Sources(), "foo-2.tar.gz"))
+	ok(t, err)
+	made, err = a.Made()
+	ok(t, err)
+	equals(t, []string{
+		path.Join(a.Packages(), "foo-2-1-x86_64.pkg.tar.zst"),
+		path.Join(a.Packages(), "foo-docs-2-1-any.pkg.tar.zst"),
+	}, made)
+
+	// Sources are shared between versions, packages aren't.
+	b := NewAurPackage(root, "foo", "1-1", "3-1", "")
+	equals(t, a.Sources(), b.Sources())
+	made, err = b.Made()
+	ok(t, err)
+	equals(t, 0, len(made))
+}
+
+func TestGroupByBase(t *testing.T) {
+	pkg := func(name, base string, dependency bool) *AurPackage {
+		p := NewAurPackage("/root", name, "1-1", "2-1", "")
+		p.PackageBase = base
+		p.Dependency = dependency
+		return p
+	}
+	grouped := GroupByBase([]*AurPackage{
+		pkg("foo", "foo-base", true),
+		pkg("bar", "", true),
+		pkg("foo-docs", "foo-base", false),
+		pkg("foo-extras", "foo-base", true),
+	})
+	equals(t, 2, len(grouped))
+	foo := grouped[0]
+	equals(t, "foo", foo.Name)
+	equals(t, []string{"foo", "foo-docs", "foo-extras"}, foo.Wanted())
+	assert(t, !foo.Dependency, "foo-docs was asked for, so the group was")
+	equals(t, ":: foo 1-1 -> 2-1 (with foo-docs, foo-extras)", foo.String())
+	equals(t, "bar", grouped[1].Name)
+	equals(t, []string{"bar"}, grouped[1].Wanted())
+}
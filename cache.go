@@ -0,0 +1,183 @@
+package poltroon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CachedVersion is one version of a package kept under a package root
+// by an earlier run, or the sources shared by its versions.
+type CachedVersion struct {
+	Name    string
+	Version string
+	Path    string
+	// Sources is set for a package's downloaded sources, rather than
+	// a version.  Version is then SourcesDir.
+	Sources bool
+	// Size is the total size of the files it holds.
+	Size int64
+	// ModTime is when it was last prepared.
+	ModTime time.Time
+}
+
+// ScanCache returns every version of every package under root, and
+// the sources each package has downloaded.
+func ScanCache(root string) ([]*CachedVersion, error) {
+	names, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "scanning cache")
+	}
+	var result []*CachedVersion
+	for _, n := range names {
+		if !n.IsDir() {
+			continue
+		}
+		versions, err := ioutil.ReadDir(path.Join(root, n.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "scanning cache")
+		}
+		for _, v := range versions {
+			if !v.IsDir() {
+				continue
+			}
+			cv := &CachedVersion{
+				Name:    n.Name(),
+				Version: v.Name(),
+				Path:    path.Join(root, n.Name(), v.Name()),
+				Sources: v.Name() == SourcesDir,
+				ModTime: v.ModTime(),
+			}
+			if cv.Size, err = diskSize(cv.Path); err != nil {
+				return nil, err
+			}
+			result = append(result, cv)
+		}
+	}
+	return result, nil
+}
+
+func diskSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, errors.Wrapf(err, "sizing %s", dir)
+}
+
+// CleanPolicy says which cached versions to remove.  A zero value for
+// any field turns that part of the policy off.
+type CleanPolicy struct {
+	// KeepLast is how many of the most recently prepared versions of
+	// each package to keep.
+	KeepLast int
+	// MaxSize is the most space, in bytes, that the versions and
+	// sources kept may take up.  The least recently used go first, and
+	// a package's sources go with its last version.
+	MaxSize int64
+	// Installed holds the names of installed packages.  If it is not
+	// nil, every version, and the sources, of every other package are
+	// removed.
+	Installed map[string]bool
+}
+
+// Select returns the versions in cached that p says to remove.
+func (p CleanPolicy) Select(cached []*CachedVersion) []*CachedVersion {
+	sorted := make([]*CachedVersion, len(cached))
+	copy(sorted, cached)
+	// newest first
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ModTime.After(sorted[j].ModTime)
+	})
+
+	var result, kept []*CachedVersion
+	seen := map[string]int{}
+	for _, cv := range sorted {
+		if !cv.Sources {
+			seen[cv.Name]++
+		}
+		switch {
+		case p.Installed != nil && !p.Installed[cv.Name]:
+			result = append(result, cv)
+		case !cv.Sources && p.KeepLast > 0 && seen[cv.Name] > p.KeepLast:
+			result = append(result, cv)
+		default:
+			kept = append(kept, cv)
+		}
+	}
+
+	if p.MaxSize > 0 {
+		var total int64
+		versions := map[string]int{}
+		sources := map[string]*CachedVersion{}
+		for _, cv := range kept {
+			total += cv.Size
+			if cv.Sources {
+				sources[cv.Name] = cv
+			} else {
+				versions[cv.Name]++
+			}
+		}
+		removed := map[*CachedVersion]bool{}
+		remove := func(cv *CachedVersion) {
+			result = append(result, cv)
+			removed[cv] = true
+			total -= cv.Size
+		}
+		for i := len(kept) - 1; i >= 0 && total > p.MaxSize; i-- {
+			cv := kept[i]
+			if removed[cv] {
+				continue
+			}
+			remove(cv)
+			if cv.Sources {
+				continue
+			}
+			// RemoveCached takes the sources with the last version.
+			versions[cv.Name]--
+			if src := sources[cv.Name]; src != nil && versions[cv.Name] == 0 && !removed[src] {
+				remove(src)
+			}
+		}
+	}
+	return result
+}
+
+// RemoveCached removes versions from the cache under root.  Packages
+// left with no versions have their downloaded sources removed too.
+func RemoveCached(root string, versions []*CachedVersion) error {
+	names := map[string]bool{}
+	for _, cv := range versions {
+		if err := os.RemoveAll(cv.Path); err != nil {
+			return errors.Wrapf(err, "removing %s", cv.Path)
+		}
+		names[cv.Name] = true
+	}
+	for n := range names {
+		dir := path.Join(root, n)
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return errors.Wrap(err, "cleaning cache")
+		}
+		if len(entries) == 0 || (len(entries) == 1 && entries[0].Name() == SourcesDir) {
+			if err = os.RemoveAll(dir); err != nil {
+				return errors.Wrapf(err, "removing %s", dir)
+			}
+		}
+	}
+	return nil
+}
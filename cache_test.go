@@ -0,0 +1,100 @@
+package poltroon
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func cached(name, version string, size int64, age int) *CachedVersion {
+	return &CachedVersion{
+		Name:    name,
+		Version: version,
+		Size:    size,
+		ModTime: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC).Add(-time.Duration(age) * time.Hour),
+	}
+}
+
+func selected(p CleanPolicy, cached []*CachedVersion) []string {
+	result := []string{}
+	for _, cv := range p.Select(cached) {
+		result = append(result, cv.Name+"/"+cv.Version)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func cachedSources(name string, size int64, age int) *CachedVersion {
+	cv := cached(name, SourcesDir, size, age)
+	cv.Sources = true
+	return cv
+}
+
+func TestCleanPolicy(t *testing.T) {
+	all := []*CachedVersion{
+		cached("foo", "1-1", 100, 3),
+		cached("foo", "2-1", 100, 2),
+		cached("foo", "3-1", 100, 1),
+		cached("bar", "1-1", 50, 5),
+		cached("baz", "1-1", 10, 0),
+		cachedSources("foo", 20, 4),
+		cachedSources("bar", 30, 0),
+	}
+
+	tests := []struct {
+		name     string
+		policy   CleanPolicy
+		expected []string
+	}{
+		{"nothing", CleanPolicy{}, []string{}},
+		{"keep last", CleanPolicy{KeepLast: 2}, []string{"foo/1-1"}},
+		{"max size", CleanPolicy{MaxSize: 240}, []string{"bar/1-1", "bar/sources", "foo/1-1", "foo/sources"}},
+		{"max size old sources", CleanPolicy{MaxSize: 320}, []string{"bar/1-1", "bar/sources", "foo/sources"}},
+		{"max size last version", CleanPolicy{MaxSize: 380}, []string{"bar/1-1", "bar/sources"}},
+		{"uninstalled", CleanPolicy{Installed: map[string]bool{"foo": true}}, []string{"bar/1-1", "bar/sources", "baz/1-1"}},
+		{"combined", CleanPolicy{KeepLast: 1, MaxSize: 100, Installed: map[string]bool{"foo": true, "bar": true, "baz": true}},
+			[]string{"bar/1-1", "bar/sources", "foo/1-1", "foo/2-1", "foo/3-1", "foo/sources"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			equals(t, test.expected, selected(test.policy, all))
+		})
+	}
+}
+
+func TestScanAndRemoveCached(t *testing.T) {
+	root, err := ioutil.TempDir("", "poltroon_cache_test")
+	ok(t, err)
+	defer os.RemoveAll(root)
+
+	for _, v := range []string{"1-1", "2-1"} {
+		a := NewAurPackage(root, "foo", "", v, "")
+		ok(t, a.PreparePackageDir(0755))
+		ok(t, ioutil.WriteFile(path.Join(a.Packages(), "foo-"+v+"-any.pkg.tar.zst"), []byte("12345"), 0644))
+	}
+
+	scanned, err := ScanCache(root)
+	ok(t, err)
+	equals(t, 3, len(scanned))
+	equals(t, "foo", scanned[0].Name)
+	equals(t, "1-1", scanned[0].Version)
+	equals(t, int64(5), scanned[0].Size)
+	assert(t, !scanned[0].Sources, "expected 1-1 to be a version")
+	equals(t, SourcesDir, scanned[2].Version)
+	assert(t, scanned[2].Sources, "expected %s to be the sources", scanned[2].Path)
+
+	ok(t, RemoveCached(root, scanned[:1]))
+	_, err = os.Stat(path.Join(root, "foo", SourcesDir))
+	ok(t, err)
+
+	ok(t, RemoveCached(root, scanned[1:]))
+	_, err = os.Stat(path.Join(root, "foo"))
+	assert(t, os.IsNotExist(err), "expected foo to be removed along with its sources")
+
+	scanned, err = ScanCache(path.Join(root, "missing"))
+	ok(t, err)
+	equals(t, 0, len(scanned))
+}
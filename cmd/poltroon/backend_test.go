@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ginabythebay/poltroon/exec"
+)
+
+// runWithFake runs poltroon in this process with args, using fake in
+// place of pacman and makepkg.  Only runs that succeed can be tested
+// this way, since poltroon exits on failure.
+func runWithFake(h *harness, fake *exec.Fake, args ...string) {
+	oldFind, oldArgs := findBackend, os.Args
+	defer func() {
+		findBackend, os.Args = oldFind, oldArgs
+	}()
+	findBackend = func() (exec.PackageQuerier, exec.Builder, error) {
+		return fake, fake, nil
+	}
+	os.Args = append([]string{"poltroon"}, h.flags(args...)...)
+	main()
+}
+
+func TestFakeBackendUpdate(t *testing.T) {
+	h := newHarness(t, []fixture{
+		{name: "foo", version: "2-1", depends: []string{"lib", "glibc"}},
+		{name: "lib", version: "1-1"},
+		{name: "bar", version: "1-1"},
+	}, map[string]string{"foo": "1-1", "bar": "1-1"})
+	defer h.close()
+
+	fake := &exec.Fake{Available: map[string]bool{"glibc": true}}
+	runWithFake(h, fake, "--update")
+	equals(t, []string{"lib", "foo"}, fake.Made())
+	// lib had to be installed before foo could be made.
+	equals(t, []string{"lib"}, fake.Installed())
+}
+
+func TestFakeBackendNamed(t *testing.T) {
+	h := newHarness(t, []fixture{
+		{name: "app", version: "1.0-1", depends: []string{"glibc"}},
+	}, nil)
+	defer h.close()
+
+	fake := &exec.Fake{Available: map[string]bool{"glibc": true}}
+	runWithFake(h, fake, "app")
+	equals(t, []string{"app"}, fake.Made())
+
+	// The version we made is reused the next time.
+	runWithFake(h, fake, "app")
+	equals(t, []string{"app"}, fake.Made())
+}
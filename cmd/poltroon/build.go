@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/urfave/cli"
+)
+
+var buildCommand = cli.Command{
+	Name:  "build",
+	Usage: "Make packages from local archives, laid out like AUR snapshots",
+	ArgsUsage: strings.TrimSpace(`
+[archives] One or more tar files, optionally compressed with gzip, xz, zstd or bzip2.
+Each must hold a single directory, named like the archive (e.g. foo/ in foo.tar.zst),
+containing a PKGBUILD.
+`),
+	Action: buildAction,
+}
+
+func buildAction(c *cli.Context) error {
+	if !c.Args().Present() {
+		fmt.Println("build needs at least one archive.  Nothing to do.")
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	watchSignals()
+
+	root, err := getRoot()
+	if err != nil {
+		fatal(err)
+	}
+	_, builder, err := findBackend()
+	if err != nil {
+		fatal(err)
+	}
+
+	var aurPkgs []*poltroon.AurPackage
+	for _, a := range c.Args() {
+		abs, err := filepath.Abs(a)
+		if err != nil {
+			fatal(err)
+		}
+		if _, err = os.Stat(abs); err != nil {
+			fatal(err)
+		}
+		pkg := poltroon.NewAurPackage(root, archiveName(abs), "", "", fileScheme+abs)
+		aurPkgs = append(aurPkgs, pkg)
+	}
+
+	makeAll(builder, root, aurPkgs, start)
+	return nil
+}
+
+// archiveName returns the name of an archive without its directory
+// or any .tar.* extension.
+func archiveName(p string) string {
+	name := filepath.Base(p)
+	if i := strings.Index(name, ".tar"); i > 0 {
+		return name[:i]
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var cleanCommand = cli.Command{
+	Name:  "clean",
+	Usage: "Remove package versions made by earlier runs",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:  "keep",
+			Usage: "Keep only the most recently made N versions of each package",
+		},
+		cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Remove the oldest versions and downloaded sources until the rest take up at most this much space, e.g. 500M or 2G",
+		},
+		cli.BoolFlag{
+			Name:  "uninstalled",
+			Usage: "Remove every version, and the sources, of packages that aren't installed",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run, n",
+			Usage: "Print what would be removed without removing it",
+		},
+	},
+	Action: cleanAction,
+}
+
+func cleanAction(c *cli.Context) error {
+	policy := poltroon.CleanPolicy{KeepLast: c.Int("keep")}
+	if s := c.String("max-size"); s != "" {
+		size, err := parseSize(s)
+		if err != nil {
+			fatal(err)
+		}
+		policy.MaxSize = size
+	}
+	if c.Bool("uninstalled") {
+		local, err := pacmanDB.Local()
+		if err != nil {
+			fatal(err)
+		}
+		policy.Installed = map[string]bool{}
+		for _, p := range local {
+			policy.Installed[p.Name] = true
+		}
+	}
+	if policy.KeepLast == 0 && policy.MaxSize == 0 && policy.Installed == nil {
+		fmt.Println("clean needs at least one of --keep, --max-size or --uninstalled.  Nothing to do.")
+		os.Exit(1)
+	}
+
+	root := settings.PackageRoot()
+	cached, err := poltroon.ScanCache(root)
+	if err != nil {
+		fatal(err)
+	}
+	remove := policy.Select(cached)
+	var freed int64
+	for _, cv := range remove {
+		fmt.Printf("%s %s (%s)\n", cv.Name, cv.Version, formatSize(cv.Size))
+		freed += cv.Size
+	}
+	if c.Bool("dry-run") {
+		fmt.Printf("Would remove %d versions, freeing %s\n", len(remove), formatSize(freed))
+		return nil
+	}
+	if err = poltroon.RemoveCached(root, remove); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Removed %d versions, freeing %s\n", len(remove), formatSize(freed))
+	return nil
+}
+
+var sizeUnits = []string{"K", "M", "G", "T"}
+
+// parseSize parses a number of bytes, optionally followed by K, M, G
+// or T (powers of 1024).
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.ToUpper(strings.TrimSpace(s))
+	for i, u := range sizeUnits {
+		if strings.HasSuffix(num, u) {
+			num = strings.TrimSuffix(num, u)
+			mult = 1 << (10 * uint(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("%q is not a size", s)
+	}
+	return n * mult, nil
+}
+
+func formatSize(n int64) string {
+	unit := ""
+	f := float64(n)
+	for _, u := range sizeUnits {
+		if f < 1024 {
+			break
+		}
+		f /= 1024
+		unit = u
+	}
+	if unit == "" {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.1f%siB", f, unit)
+}
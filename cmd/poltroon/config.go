@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/ginabythebay/poltroon/conf"
+	"github.com/urfave/cli"
+)
+
+var configCommand = cli.Command{
+	Name:  "config",
+	Usage: "Work with the poltroon configuration",
+	Subcommands: []cli.Command{
+		{
+			Name:  "show",
+			Usage: "Print the effective configuration, in config file format",
+			Action: func(c *cli.Context) error {
+				return settings.Write(os.Stdout)
+			},
+		},
+	},
+}
+
+// loadSettings reads the config file named by --config and then lets
+// any flags or environment variables that were set override it.
+// Ignore lists are added together rather than overridden.
+func loadSettings(c *cli.Context) (*conf.Config, error) {
+	s, err := conf.ReadConfig(c.String("config"))
+	if err != nil {
+		return nil, err
+	}
+	if c.IsSet("fetchers") {
+		s.Fetchers = c.Int("fetchers")
+	}
+	if c.IsSet("makers") {
+		s.Makers = c.Int("makers")
+	}
+	if c.IsSet("build-root") {
+		s.BuildRoot = c.String("build-root")
+	}
+	if c.IsSet("cache-dir") {
+		s.CacheDir = c.String("cache-dir")
+	}
+	if c.IsSet("aur-url") {
+		s.AurURL = c.String("aur-url")
+	}
+	if c.IsSet("git-url") {
+		s.GitURL = c.String("git-url")
+	}
+	if c.IsSet("dbpath") {
+		s.DBPath = c.String("dbpath")
+	}
+	if c.IsSet("repo-dir") {
+		s.RepoDir = c.String("repo-dir")
+	}
+	if c.IsSet("repo-name") {
+		s.RepoName = c.String("repo-name")
+	}
+	if c.IsSet("pacman-conf") {
+		s.PacmanConf = c.String("pacman-conf")
+	}
+	// Bools are only overridden if they were set, so that
+	// --devel=false can turn off Devel in the config file.
+	for name, b := range map[string]*bool{
+		"skippgpcheck":    &s.SkipPgpCheck,
+		"devel":           &s.Devel,
+		"git":             &s.Git,
+		"sandbox":         &s.Sandbox,
+		"sandbox-offline": &s.SandboxOffline,
+		"chroot":          &s.Chroot,
+		"noconfirm":       &s.NoConfirm,
+		"quiet":           &s.Quiet,
+		"noreview":        &s.NoReview,
+	} {
+		if c.IsSet(name) {
+			*b = c.Bool(name)
+		}
+	}
+	if c.IsSet("chroot-tarball") {
+		s.ChrootTarball = c.String("chroot-tarball")
+	}
+	if c.IsSet("build-timeout") {
+		s.BuildTimeout = c.Duration("build-timeout")
+	}
+	if c.IsSet("total-timeout") {
+		s.TotalTimeout = c.Duration("total-timeout")
+	}
+	if ignore := c.String("ignore"); ignore != "" {
+		s.IgnorePkg = append(s.IgnorePkg, strings.Split(ignore, ",")...)
+	}
+	return s, nil
+}
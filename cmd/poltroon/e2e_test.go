@@ -0,0 +1,592 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The end to end tests run the test binary itself as poltroon, with
+// this set in the environment.
+const runMainEnv = "POLTROON_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fixture is a package in the fake AUR.
+type fixture struct {
+	name    string
+	version string
+	depends []string
+	// source lists the sources, with $AUR standing for the fake
+	// AUR's URL.
+	source []string
+	// build is the body of the PKGBUILD's build function, if any.
+	build string
+}
+
+func (f fixture) pkgbuild() string {
+	dash := strings.LastIndex(f.version, "-")
+	s := fmt.Sprintf("pkgname=%s\npkgver=%s\npkgrel=%s\narch=(x86_64)\n", f.name, f.version[:dash], f.version[dash+1:])
+	if len(f.depends) != 0 {
+		s += fmt.Sprintf("depends=('%s')\n", strings.Join(f.depends, "' '"))
+	}
+	if len(f.source) != 0 {
+		s += fmt.Sprintf("source=('%s')\n", strings.Join(f.source, "' '"))
+	}
+	if f.build != "" {
+		s += fmt.Sprintf("build() {\n\t%s\n}\n", f.build)
+	}
+	return s
+}
+
+func (f fixture) srcinfo() string {
+	dash := strings.LastIndex(f.version, "-")
+	s := fmt.Sprintf("pkgbase = %s\n\tpkgver = %s\n\tpkgrel = %s\n\tarch = x86_64\n", f.name, f.version[:dash], f.version[dash+1:])
+	for _, d := range f.depends {
+		s += fmt.Sprintf("\tdepends = %s\n", d)
+	}
+	for _, src := range f.source {
+		s += fmt.Sprintf("\tsource = %s\n", src)
+	}
+	return s + fmt.Sprintf("\npkgname = %s\n", f.name)
+}
+
+// snapshot returns a gzipped tarball like the AUR serves.
+func (f fixture) snapshot() ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	if err := w.WriteHeader(&tar.Header{Name: f.name + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		return nil, err
+	}
+	files := []struct{ name, contents string }{
+		{"PKGBUILD", f.pkgbuild()},
+		{".SRCINFO", f.srcinfo()},
+	}
+	for _, file := range files {
+		h := &tar.Header{Name: f.name + "/" + file.name, Mode: 0644, Size: int64(len(file.contents)), Typeflag: tar.TypeReg}
+		if err := w.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(file.contents)); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newFakeAur serves the rpc info call and snapshots for fixtures.
+// Anything under /upstream/ is counted in upstreamHits and not found,
+// which is enough for upstream sources to point at.
+func newFakeAur(fixtures []fixture, upstreamHits *int32) *httptest.Server {
+	byName := map[string]fixture{}
+	for _, f := range fixtures {
+		byName[f.name] = f
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rpc/", func(w http.ResponseWriter, r *http.Request) {
+		results := []map[string]interface{}{}
+		for _, n := range r.URL.Query()["arg[]"] {
+			f, ok := byName[n]
+			if !ok {
+				continue
+			}
+			results = append(results, map[string]interface{}{
+				"Name":        f.name,
+				"PackageBase": f.name,
+				"Version":     f.version,
+				"URLPath":     "/cgit/aur.git/snapshot/" + f.name + ".tar.gz",
+				"Depends":     f.depends,
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version":     5,
+			"type":        "multiinfo",
+			"resultcount": len(results),
+			"results":     results,
+		})
+	})
+	mux.HandleFunc("/cgit/aur.git/snapshot/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(path.Base(r.URL.Path), ".tar.gz")
+		f, ok := byName[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var sources []string
+		for _, src := range f.source {
+			sources = append(sources, strings.Replace(src, "$AUR", "http://"+r.Host, -1))
+		}
+		f.source = sources
+		data, err := f.snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	})
+	mux.HandleFunc("/upstream/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(upstreamHits, 1)
+		http.NotFound(w, r)
+	})
+	return httptest.NewServer(mux)
+}
+
+// Stub programs put on the path in place of the real ones.  pacman
+// treats anything in $E2E_REPO as available from the repositories and
+// logs what it installs in $E2E_DIR/installed.  makepkg runs the
+// PKGBUILD's build function and then writes a package holding just a
+// .PKGINFO.
+var stubs = map[string]string{
+	"sudo": `#!/bin/bash
+[ "$1" = --validate ] && exit 0
+exec "$@"
+`,
+	"pacman": `#!/bin/bash
+case "$1" in
+--deptest)
+	shift
+	status=0
+	for d in "$@"; do
+		case " $E2E_REPO " in
+		*" ${d%%[<>=]*} "*) ;;
+		*) echo "$d"; status=127 ;;
+		esac
+	done
+	exit $status ;;
+--sync)
+	exit 1 ;;
+--upgrade)
+	shift
+	for a in "$@"; do
+		case "$a" in
+		--*) ;;
+		*) basename "$a" >> "$E2E_DIR/installed" ;;
+		esac
+	done ;;
+esac
+`,
+	"makepkg": `#!/bin/bash
+set -e
+source ./PKGBUILD
+if declare -f build > /dev/null; then
+	build
+fi
+tmp=$(mktemp -d)
+printf 'pkgname = %s\npkgbase = %s\npkgver = %s-%s\narch = x86_64\n' \
+	"$pkgname" "$pkgname" "$pkgver" "$pkgrel" > "$tmp/.PKGINFO"
+tar -czf "$PKGDEST/$pkgname-$pkgver-$pkgrel-x86_64.pkg.tar.gz" -C "$tmp" .PKGINFO
+rm -r "$tmp"
+`,
+}
+
+// harness runs poltroon against a fake AUR, with stub pacman, makepkg
+// and sudo.
+type harness struct {
+	t   *testing.T
+	dir string
+	aur *httptest.Server
+	env []string
+	// review turns off --noconfirm, so packages are reviewed.
+	review bool
+	// upstreamHits counts requests for upstream sources.
+	upstreamHits int32
+}
+
+// newHarness sets up a harness serving fixtures, with installed as
+// the local pacman database (name to version) and repo naming the
+// packages the sync repositories provide.
+func newHarness(t *testing.T, fixtures []fixture, installed map[string]string, repo ...string) *harness {
+	dir, err := ioutil.TempDir("", "poltroon_e2e_test")
+	ok(t, err)
+	bin := path.Join(dir, "bin")
+	ok(t, os.MkdirAll(bin, 0755))
+	for name, script := range stubs {
+		ok(t, ioutil.WriteFile(path.Join(bin, name), []byte(script), 0755))
+	}
+	for name, version := range installed {
+		entry := path.Join(dir, "db", "local", name+"-"+version)
+		ok(t, os.MkdirAll(entry, 0755))
+		desc := fmt.Sprintf("%%NAME%%\n%s\n\n%%VERSION%%\n%s\n\n", name, version)
+		ok(t, ioutil.WriteFile(path.Join(entry, "desc"), []byte(desc), 0644))
+	}
+	ok(t, os.MkdirAll(path.Join(dir, "db", "sync"), 0755))
+	ok(t, ioutil.WriteFile(path.Join(dir, "pacman.conf"), []byte("[options]\n"), 0644))
+
+	env := []string{runMainEnv + "=1"}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "POLTROON_") && !strings.HasPrefix(e, "PATH=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env,
+		"PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"),
+		"E2E_DIR="+dir,
+		"E2E_REPO="+strings.Join(repo, " "))
+	h := &harness{t: t, dir: dir, env: env}
+	h.aur = newFakeAur(fixtures, &h.upstreamHits)
+	return h
+}
+
+func (h *harness) close() {
+	h.aur.Close()
+	os.RemoveAll(h.dir)
+}
+
+// flags returns args, plus flags pointing poltroon at the harness.
+func (h *harness) flags(args ...string) []string {
+	flags := []string{
+		"--aur-url", h.aur.URL,
+		"--cache-dir", path.Join(h.dir, "cache"),
+		"--dbpath", path.Join(h.dir, "db"),
+		"--config", path.Join(h.dir, "poltroon.conf"),
+		"--pacman-conf", path.Join(h.dir, "pacman.conf"),
+		"--quiet",
+	}
+	if !h.review {
+		flags = append(flags, "--noconfirm")
+	}
+	return append(flags, args...)
+}
+
+// command returns a command to run poltroon with args, plus flags
+// pointing it at the harness.
+func (h *harness) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], h.flags(args...)...)
+	cmd.Env = h.env
+	return cmd
+}
+
+// run runs poltroon to completion, returning its output and exit
+// status.
+func (h *harness) run(args ...string) (string, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	out, err := h.command(ctx, args...).CombinedOutput()
+	return string(out), exitCode(h.t, err)
+}
+
+// installed returns the package files pacman was asked to install.
+func (h *harness) installed() []string {
+	data, err := ioutil.ReadFile(path.Join(h.dir, "installed"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	ok(h.t, err)
+	return strings.Fields(string(data))
+}
+
+func exitCode(t *testing.T, err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, isExit := err.(*exec.ExitError)
+	assert(t, isExit, "running poltroon: %v", err)
+	return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+}
+
+// madePaths returns the package files the summary says to install.
+func madePaths(out string) []string {
+	const prefix = "sudo pacman -U --noconfirm "
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.Fields(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return nil
+}
+
+func contains(t *testing.T, out string, want ...string) {
+	for _, w := range want {
+		if !strings.Contains(out, w) {
+			_, file, line, _ := runtime.Caller(1)
+			t.Fatalf("%s:%d: missing %q in output:\n%s", filepath.Base(file), line, w, out)
+		}
+	}
+}
+
+func TestEndToEndUpdate(t *testing.T) {
+	h := newHarness(t, []fixture{
+		{name: "foo", version: "2-1", depends: []string{"glibc"}},
+		{name: "bar", version: "1-1"},
+	}, map[string]string{"foo": "1-1", "bar": "1-1"}, "glibc")
+	defer h.close()
+
+	out, status := h.run("--update")
+	equals(t, 0, status)
+	contains(t, out, "foo 1-1 -> 2-1", "Created 1 packages")
+	paths := madePaths(out)
+	equals(t, 1, len(paths))
+	equals(t, "foo-2-1-x86_64.pkg.tar.gz", path.Base(paths[0]))
+	_, err := os.Stat(paths[0])
+	ok(t, err)
+
+	// The version we made is reused the next time.
+	out, status = h.run("--update")
+	equals(t, 0, status)
+	contains(t, out, "foo: already made 2-1, not making it again", "Created 1 packages")
+	equals(t, paths, madePaths(out))
+}
+
+func TestEndToEndNamed(t *testing.T) {
+	h := newHarness(t, []fixture{
+		{name: "app", version: "1.0-1", depends: []string{"lib>=2", "glibc"}},
+		{name: "lib", version: "2.1-1"},
+	}, nil, "glibc")
+	defer h.close()
+
+	out, status := h.run("app")
+	equals(t, 0, status)
+	contains(t, out, "Adding 1 AUR dependencies", "Created 2 packages")
+	var names []string
+	for _, p := range madePaths(out) {
+		names = append(names, path.Base(p))
+	}
+	equals(t, []string{"lib-2.1-1-x86_64.pkg.tar.gz", "app-1.0-1-x86_64.pkg.tar.gz"}, names)
+	// lib had to be installed before app could be made.
+	equals(t, []string{"lib-2.1-1-x86_64.pkg.tar.gz"}, h.installed())
+}
+
+func TestEndToEndFailure(t *testing.T) {
+	h := newHarness(t, []fixture{
+		{name: "broken", version: "1-1", build: "echo oops >&2; exit 1"},
+		{name: "needy", version: "1-1", depends: []string{"broken"}},
+		{name: "fine", version: "1-1"},
+	}, nil)
+	defer h.close()
+
+	out, status := h.run("needy", "fine")
+	equals(t, 1, status)
+	contains(t, out,
+		"***Error processing broken, see ",
+		"***Skipped needy because broken failed***",
+		"Created 1 packages")
+	paths := madePaths(out)
+	equals(t, 1, len(paths))
+	equals(t, "fine-1-1-x86_64.pkg.tar.gz", path.Base(paths[0]))
+
+	logs := path.Join(h.dir, "cache", "packages", "broken", "1-1", "logs", "make.err")
+	data, err := ioutil.ReadFile(logs)
+	ok(t, err)
+	equals(t, "oops\n", string(data))
+}
+
+func TestEndToEndTimeouts(t *testing.T) {
+	h := newHarness(t, []fixture{
+		{name: "slow", version: "1-1", build: "sleep 60"},
+		{name: "needy", version: "1-1", depends: []string{"slow"}},
+		{name: "fine", version: "1-1"},
+		{name: "slower", version: "1-1", build: "sleep 60"},
+	}, nil)
+	defer h.close()
+	conf := "[pkg slow]\nBuildTimeout = 1s\n"
+	ok(t, ioutil.WriteFile(path.Join(h.dir, "poltroon.conf"), []byte(conf), 0644))
+
+	out, status := h.run("needy", "fine")
+	equals(t, 1, status)
+	contains(t, out,
+		"***slow went over a limit: took longer than the 1s BuildTimeout***",
+		"***Skipped needy because slow failed***",
+		"Created 1 packages")
+
+	out, status = h.run("--total-timeout", "1s", "slower")
+	equals(t, 1, status)
+	contains(t, out, "***slower went over a limit: took longer than the 1s TotalTimeout***")
+}
+
+func TestEndToEndCancel(t *testing.T) {
+	started := "touch \"$E2E_DIR/started\"; sleep 60"
+	h := newHarness(t, []fixture{
+		{name: "slow", version: "1-1", build: started},
+		{name: "after", version: "1-1", depends: []string{"slow"}},
+	}, nil)
+	defer h.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := h.command(ctx, "after")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	ok(t, cmd.Start())
+	for {
+		if _, err := os.Stat(path.Join(h.dir, "started")); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("slow never started:\n%s", out.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// Once to stop starting things, and again to stop the make.
+	ok(t, cmd.Process.Signal(os.Interrupt))
+	time.Sleep(100 * time.Millisecond)
+	ok(t, cmd.Process.Signal(os.Interrupt))
+
+	status := exitCode(t, cmd.Wait())
+	equals(t, 1, status)
+	contains(t, out.String(),
+		"slow: make cancelled",
+		"***Cancelled slow***",
+		"***Cancelled after***",
+		"Interrupted, so 2 packages were cancelled",
+		"Created 0 packages")
+}
+
+// Packages ready to make but waiting for a maker are cancelled by the
+// first interrupt, along with everything not ready yet.
+func TestEndToEndCancelQueued(t *testing.T) {
+	started := "touch \"$E2E_DIR/started\"; sleep 2"
+	h := newHarness(t, []fixture{
+		{name: "one", version: "1-1", build: started},
+		{name: "two", version: "1-1", build: started},
+	}, nil)
+	defer h.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var out bytes.Buffer
+	cmd := h.command(ctx, "--makers", "1", "one", "two")
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	ok(t, cmd.Start())
+	for {
+		if _, err := os.Stat(path.Join(h.dir, "started")); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("nothing started:\n%s", out.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	ok(t, cmd.Process.Signal(os.Interrupt))
+
+	status := exitCode(t, cmd.Wait())
+	equals(t, 1, status)
+	contains(t, out.String(),
+		"Interrupted, so 1 packages were cancelled",
+		"Created 1 packages")
+}
+
+func TestEndToEndReview(t *testing.T) {
+	if _, err := exec.LookPath("diff"); err != nil {
+		t.Skip("diff not available")
+	}
+	h := newHarness(t, []fixture{
+		{name: "foo-git", version: "1-1", source: []string{"git+$AUR/upstream/foo.git"}},
+		{name: "bar-git", version: "1-1", source: []string{"git+$AUR/upstream/bar.git"}},
+		{name: "baz", version: "1-1"},
+	}, nil)
+	defer h.close()
+	h.review = true
+	h.env = append(h.env, "PAGER=cat")
+
+	review := func(answer string, args ...string) (string, int) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		cmd := h.command(ctx, args...)
+		cmd.Stdin = strings.NewReader(answer)
+		out, err := cmd.CombinedOutput()
+		return string(out), exitCode(t, err)
+	}
+
+	// Nothing the package names is contacted until it is approved.
+	out, status := review("n\n", "--devel", "foo-git")
+	equals(t, 1, status)
+	contains(t, out, "+\tsource = git+http://", "***Did not make foo-git because it was not approved***")
+	equals(t, int32(0), atomic.LoadInt32(&h.upstreamHits))
+
+	// Or at all, without --devel.
+	out, status = review("y\n", "foo-git")
+	equals(t, 0, status)
+	contains(t, out, "Created 1 packages")
+	equals(t, int32(0), atomic.LoadInt32(&h.upstreamHits))
+
+	out, status = review("y\n", "--devel", "bar-git")
+	equals(t, 0, status)
+	contains(t, out, "bar-git: warning: unable to check upstream sources", "Created 1 packages")
+	assert(t, atomic.LoadInt32(&h.upstreamHits) != 0, "expected upstream to be checked once approved:\n%s", out)
+
+	// A review that can't be shown is a failure, not a rejection.
+	ok(t, ioutil.WriteFile(path.Join(h.dir, "cache", "reviewed", "baz"), []byte("not a snapshot"), 0644))
+	out, status = review("y\n", "baz")
+	equals(t, 1, status)
+	contains(t, out, "baz: failed to review due to", "***Failed to review baz: ")
+	assert(t, !strings.Contains(out, "not approved"), "expected a review failure, not a rejection:\n%s", out)
+}
+
+func TestEndToEndConfigOverride(t *testing.T) {
+	h := newHarness(t, nil, nil)
+	defer h.close()
+	ok(t, ioutil.WriteFile(path.Join(h.dir, "poltroon.conf"), []byte("[options]\nDevel\nGit\nSandbox\n"), 0644))
+
+	out, status := h.run("config", "show")
+	equals(t, 0, status)
+	contains(t, out, "Devel = true", "Git = true", "Sandbox = true")
+
+	// Flags and the environment can turn off what the config file
+	// turns on.
+	h.env = append(h.env, "POLTROON_GIT=false")
+	out, status = h.run("--devel=false", "config", "show")
+	equals(t, 0, status)
+	contains(t, out, "Devel = false", "Git = false", "Sandbox = true")
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/exec"
+	"github.com/pkg/errors"
+)
+
+var (
+	limitedMutex sync.Mutex
+	// why packages were stopped for going over a limit, by name
+	limitedReasons = map[string]string{}
+)
+
+// startBuildClock returns the context makes run in for one run:
+// killCtx, plus the TotalTimeout if there is one.  Makes are stopped
+// when it is done.  The returned function releases it.
+func startBuildClock() (context.Context, context.CancelFunc) {
+	if settings.TotalTimeout == 0 {
+		return context.WithCancel(killCtx)
+	}
+	return context.WithTimeout(killCtx, settings.TotalTimeout)
+}
+
+// totalTimeoutPassed says whether buildCtx, from startBuildClock, ran
+// out of time.
+func totalTimeoutPassed(buildCtx context.Context) bool {
+	return buildCtx.Err() == context.DeadlineExceeded
+}
+
+// overLimit returns why making a package was stopped, if it was for
+// going over a limit, and nil otherwise.  err is what making it
+// returned, with ctx and timeout what it was made with, and buildCtx
+// what ctx came from.
+func overLimit(err error, buildCtx, ctx context.Context, timeout time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	// A make can fail on its own just as the whole run runs out of
+	// time, so only a make whose context ended was stopped by a
+	// timeout.
+	if ctx.Err() != nil {
+		if totalTimeoutPassed(buildCtx) {
+			return errors.Errorf("took longer than the %s TotalTimeout", settings.TotalTimeout)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("took longer than the %s BuildTimeout", timeout)
+		}
+	}
+	if l, ok := errors.Cause(err).(*exec.LimitError); ok {
+		return l
+	}
+	return nil
+}
+
+// markLimited records in state that pkg was stopped for going over a
+// limit, for the reason in err.
+func markLimited(state *poltroon.UpdateState, pkg *poltroon.AurPackage, err error) {
+	limitedMutex.Lock()
+	limitedReasons[pkg.Name] = err.Error()
+	limitedMutex.Unlock()
+	state.Limited(pkg, err)
+}
+
+// limitedReason returns why pkg was stopped for going over a limit,
+// if it was.
+func limitedReason(pkg *poltroon.AurPackage) (string, bool) {
+	limitedMutex.Lock()
+	defer limitedMutex.Unlock()
+	reason, ok := limitedReasons[pkg.Name]
+	return reason, ok
+}
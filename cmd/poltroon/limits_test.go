@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ginabythebay/poltroon/exec"
+	"github.com/pkg/errors"
+)
+
+func TestOverLimit(t *testing.T) {
+	defer func(old time.Duration) { settings.TotalTimeout = old }(settings.TotalTimeout)
+	settings.TotalTimeout = time.Minute
+	failed := errors.New("exit status 1")
+
+	running, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expired, cancelExpired := context.WithTimeout(context.Background(), 0)
+	defer cancelExpired()
+	<-expired.Done()
+
+	equals(t, nil, overLimit(nil, expired, expired, time.Second))
+	equals(t, nil, overLimit(failed, running, running, time.Second))
+
+	// Out of time for the whole run.
+	err := overLimit(failed, expired, expired, time.Second)
+	equals(t, "took longer than the 1m0s TotalTimeout", err.Error())
+
+	// Failed on its own, just as the whole run ran out of time.
+	equals(t, nil, overLimit(failed, expired, running, time.Second))
+
+	// Out of time for this make.
+	err = overLimit(failed, running, expired, time.Second)
+	equals(t, "took longer than the 1s BuildTimeout", err.Error())
+
+	limitErr := &exec.LimitError{Reason: "ran out of memory"}
+	equals(t, limitErr, overLimit(errors.Wrap(limitErr, "making"), running, running, time.Second))
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
+	"context"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
 	"path"
 	"strings"
@@ -15,21 +15,51 @@ import (
 	"github.com/ginabythebay/alpm"
 	"github.com/ginabythebay/poltroon"
 	"github.com/ginabythebay/poltroon/aur"
+	"github.com/ginabythebay/poltroon/conf"
 	"github.com/ginabythebay/poltroon/exec"
+	"github.com/ginabythebay/poltroon/git"
+	"github.com/ginabythebay/poltroon/pacdb"
+	"github.com/ginabythebay/poltroon/pkgfile"
+	"github.com/ginabythebay/poltroon/repo"
+	"github.com/ginabythebay/poltroon/resolve"
+	"github.com/ginabythebay/poltroon/review"
+	"github.com/ginabythebay/poltroon/srcinfo"
 	"github.com/ginabythebay/poltroon/tar"
+	"github.com/ginabythebay/poltroon/vcs"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
-const dirMode = os.ModeDir | 0770
+const (
+	dirMode = os.ModeDir | 0770
+
+	fileScheme = "file://"
+)
 
 var (
 	// work queue of things to fetch
-	fetchChan = make(chan *poltroon.AurPackage)
-	// work queue of things to make
-	makeChan = make(chan *poltroon.AurPackage)
+	fetchChan chan *poltroon.AurPackage
+	// fetched things waiting to be reviewed.  nil if we aren't
+	// reviewing.
+	reviewChan chan *poltroon.AurPackage
+	// where reviewed package files are kept between runs.  nil if we
+	// aren't reviewing.
+	reviewStore *review.Store
+	// decides when fetched things can be made
+	scheduler *poltroon.Scheduler
 
 	updateState *poltroon.UpdateState
+
+	aurClient *aur.Client
+
+	pacmanDB *pacdb.DB
+
+	// upstream revisions that development packages were made from
+	vcsStore *vcs.Store
+
+	// effective settings, from flags, the environment, the config
+	// file and defaults
+	settings *conf.Config
 )
 
 func main() {
@@ -37,52 +67,189 @@ func main() {
 	app.Usage = strings.TrimSpace(`
 Foolishly upgrade AUR packages.
 
-1. Finds foreign packages by running packman --query --foreign and
-   then consults the AUR for newer versions.  Prints out all packages
+1. Finds foreign packages by reading the pacman databases and then
+   consults the AUR for newer versions.  Prints out all packages
    found to have newer versions.
 2. Asks if the user wants to proceed.  Exits if they don't.
 3. Starts a two-stage pipeline.
 4. In the first stage, we run download the package (defaulting it 2 workers).
+   Unless --noreview or --noconfirm is set, we then show what changed in
+   each package since it was last built (through $PAGER) and ask
+   whether to make it.
 5. In the second state, we run makepkg -s to build the package files.
+   A package is only built once the AUR packages it depends on have
+   been built and installed; if one of those fails, it is skipped.
 6. At the end, we print out the command the user can run to install the packages.
 
-All the action happens in /tmp/poltroon/ with a sub-directory for each package and a logs directory within that that can be inspected.
+All the action happens in ~/.cache/poltroon/packages/ (or --build-root) with a
+sub-directory for each package and version and a logs directory within that that
+can be inspected.  Versions that were already made are not made again; see
+"poltroon clean" for removing old ones.
+
+Settings come from flags, then POLTROON_* environment variables, then
+~/.config/poltroon/poltroon.conf, then defaults.  Run "poltroon config show"
+to see the result.
 `)
 	app.ArgsUsage = strings.TrimSpace(`
 [packages] One or more named packages to fetch and make.  Not compatible with the --update flag.
+With --git, a name may be followed by @commit to make that commit.
 `)
+	defaults := conf.Default()
 	app.Flags = []cli.Flag{
 		cli.IntFlag{
-			Name:  "fetchers",
-			Value: 2,
-			Usage: "Number of concurrent fetchers",
+			Name:   "fetchers",
+			Value:  defaults.Fetchers,
+			Usage:  "Number of concurrent fetchers",
+			EnvVar: "POLTROON_FETCHERS",
 		},
 		cli.IntFlag{
-			Name:  "makers",
-			Value: 3,
-			Usage: "Number of concurrent makers",
+			Name:   "makers",
+			Value:  defaults.Makers,
+			Usage:  "Number of concurrent makers",
+			EnvVar: "POLTROON_MAKERS",
+		},
+		cli.StringFlag{
+			Name:   "build-root",
+			Usage:  "Directory to download and make packages in (default: <cache-dir>/packages)",
+			EnvVar: "POLTROON_BUILD_ROOT",
+		},
+		cli.StringFlag{
+			Name:   "cache-dir",
+			Value:  defaults.CacheDir,
+			Usage:  "Directory to keep things in between runs, such as approved PKGBUILDs",
+			EnvVar: "POLTROON_CACHE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "aur-url",
+			Value:  defaults.AurURL,
+			Usage:  "Base url of the AUR instance to query and download from",
+			EnvVar: "POLTROON_AUR_URL",
+		},
+		cli.BoolFlag{
+			Name:   "git",
+			Usage:  "Fetch packages by cloning their AUR git repositories into the cache directory, rather than downloading snapshots",
+			EnvVar: "POLTROON_GIT",
+		},
+		cli.StringFlag{
+			Name:   "git-url",
+			Usage:  "Base url (or directory) of the git repositories to clone, if not the same as --aur-url",
+			EnvVar: "POLTROON_GIT_URL",
+		},
+		cli.BoolFlag{
+			Name:   "sandbox",
+			Usage:  "Run makepkg where it can only write to the package's own directories, and can't see your home directory",
+			EnvVar: "POLTROON_SANDBOX",
+		},
+		cli.BoolFlag{
+			Name:   "sandbox-offline",
+			Usage:  "Like --sandbox, but also cut off the network once sources are downloaded",
+			EnvVar: "POLTROON_SANDBOX_OFFLINE",
+		},
+		cli.BoolFlag{
+			Name:   "chroot",
+			Usage:  "Make each package in a fresh copy of a clean root that only has what the package needs",
+			EnvVar: "POLTROON_CHROOT",
+		},
+		cli.StringFlag{
+			Name:   "chroot-tarball",
+			Usage:  "With --chroot, extract the clean root from this tarball rather than installing it with pacman",
+			EnvVar: "POLTROON_CHROOT_TARBALL",
+		},
+		cli.DurationFlag{
+			Name:   "build-timeout",
+			Usage:  "Stop making any one package after this long, such as 90m",
+			EnvVar: "POLTROON_BUILD_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "total-timeout",
+			Usage:  "Stop making packages after this long in all, such as 3h",
+			EnvVar: "POLTROON_TOTAL_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "dbpath",
+			Value:  defaults.DBPath,
+			Usage:  "Location of the pacman databases",
+			EnvVar: "POLTROON_DBPATH",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Value:  conf.DefaultConfigPath(),
+			Usage:  "Location of the poltroon config file",
+			EnvVar: "POLTROON_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "pacman-conf",
+			Value:  defaults.PacmanConf,
+			Usage:  "Location of pacman.conf, for IgnorePkg and IgnoreGroup",
+			EnvVar: "POLTROON_PACMAN_CONF",
+		},
+		cli.StringFlag{
+			Name:   "repo-dir",
+			Usage:  "Add the packages made to a local pacman repository in this directory, rather than printing a pacman -U command",
+			EnvVar: "POLTROON_REPO_DIR",
+		},
+		cli.StringFlag{
+			Name:   "repo-name",
+			Value:  defaults.RepoName,
+			Usage:  "Name of the local pacman repository, as in pacman.conf",
+			EnvVar: "POLTROON_REPO_NAME",
+		},
+		cli.StringFlag{
+			Name:   "ignore",
+			Usage:  "Comma-separated list of packages not to update, in addition to any in the config file",
+			EnvVar: "POLTROON_IGNORE",
 		},
 		cli.BoolFlag{
 			Name:  "licenses",
 			Usage: "Print out license information and exit.",
 		},
 		cli.BoolFlag{
-			Name:  "skippgpcheck",
-			Usage: "Turn off pgp checks",
+			Name:   "skippgpcheck",
+			Usage:  "Turn off pgp checks",
+			EnvVar: "POLTROON_SKIPPGPCHECK",
 		},
 		cli.BoolFlag{
 			Name:  "update, u",
 			Usage: "Look for already-installed packages to update.  Not compatible with named packages as arguments",
 		},
 		cli.BoolFlag{
-			Name:  "noconfirm",
-			Usage: "Don't ask if the user wants to proceed.",
+			Name:   "devel",
+			Usage:  "With --update, also update development packages (e.g. foo-git) whose upstream sources changed since poltroon made them",
+			EnvVar: "POLTROON_DEVEL",
+		},
+		cli.BoolFlag{
+			Name:   "noconfirm",
+			Usage:  "Don't ask if the user wants to proceed.",
+			EnvVar: "POLTROON_NOCONFIRM",
+		},
+		cli.BoolFlag{
+			Name:   "noreview",
+			Usage:  "Don't show package files and ask for approval before making them.  Implied by --noconfirm.",
+			EnvVar: "POLTROON_NOREVIEW",
 		},
 		cli.BoolFlag{
-			Name:  "quiet",
-			Usage: "Don't print progress updates.",
+			Name:   "quiet",
+			Usage:  "Don't print progress updates.",
+			EnvVar: "POLTROON_QUIET",
 		},
 	}
+	app.Before = func(c *cli.Context) error {
+		var err error
+		settings, err = loadSettings(c)
+		if err != nil {
+			fatal(err)
+		}
+		aurClient = aur.NewClient(settings.AurURL, aur.DefaultTimeout)
+		pacmanDB = pacdb.New(settings.DBPath)
+		vcsStore = vcs.NewStore(path.Join(settings.CacheDir, "vcs.json"))
+		return nil
+	}
+	app.Commands = []cli.Command{
+		searchCommand,
+		configCommand,
+		buildCommand,
+		cleanCommand,
+	}
 	app.Action = func(c *cli.Context) error {
 		if c.Bool("licenses") {
 			printAllLicenses()
@@ -90,13 +257,14 @@ All the action happens in /tmp/poltroon/ with a sub-directory for each package a
 		}
 
 		start := time.Now()
+		watchSignals()
 
 		root, err := getRoot()
 		if err != nil {
 			fatal(err)
 		}
 
-		exec, err := exec.Find()
+		querier, builder, err := findBackend()
 		if err != nil {
 			fatal(err)
 		}
@@ -107,10 +275,24 @@ All the action happens in /tmp/poltroon/ with a sub-directory for each package a
 				fmt.Printf("--update not compatible with named packages and you specified %q\n", strings.Join(args, ", "))
 				os.Exit(1)
 			}
-			aurPkgs, err = fetchChangedPkgs(exec, root)
+			ignore, err := getIgnoreList()
+			if err != nil {
+				fatal(err)
+			}
+			var ignored []*poltroon.AurPackage
+			aurPkgs, ignored, err = fetchChangedPkgs(builder, pacmanDB, root, ignore)
 			if err != nil {
 				fatal(err)
 			}
+			aurPkgs = resolveDeps(querier, root, aurPkgs)
+
+			if len(ignored) != 0 {
+				fmt.Println("Ignoring these outdated packages:")
+				for _, a := range ignored {
+					fmt.Println(a)
+				}
+				fmt.Println()
+			}
 
 			if len(aurPkgs) == 0 {
 				elapsed := time.Since(start)
@@ -123,11 +305,11 @@ All the action happens in /tmp/poltroon/ with a sub-directory for each package a
 			}
 
 			fmt.Println()
-			if c.Bool("noconfirm") {
+			if settings.NoConfirm {
 				fmt.Println("Proceeding to update all packages because --noconfirm was set...")
 			} else {
 				msg := fmt.Sprintf("Do you want to update these %d packages?", len(aurPkgs))
-				if !askForConfirmation(msg) {
+				if !askForConfirmation(stopCtx, msg) {
 					os.Exit(0)
 				}
 			}
@@ -141,65 +323,171 @@ All the action happens in /tmp/poltroon/ with a sub-directory for each package a
 			if err != nil {
 				fatal(err)
 			}
+			aurPkgs = resolveDeps(querier, root, aurPkgs)
 		}
 
-		updateState = poltroon.NewUpdateState(len(aurPkgs))
-
-		if !c.Bool("quiet") {
-			go func() {
-				for s := range updateState.Makes {
-					fmt.Print(s)
-				}
-			}()
-		}
+		makeAll(builder, root, aurPkgs, start)
+		return nil
+	}
 
-		// Start our asynchronous pipeline
-		startFetchers(exec, c.Int("fetchers"))
-		startMakers(exec, c.Int("makers"), c.Bool("skippgpcheck"))
+	app.Run(os.Args)
+}
 
-		// Push things into the pipeline here
-		for _, a := range aurPkgs {
-			fetchChan <- a
+// makeAll runs aurPkgs through the fetch, review and make pipeline
+// and prints a summary of what happened.  Exits with a status of 1 if
+// any package wasn't made.
+func makeAll(backend exec.Builder, root string, aurPkgs []*poltroon.AurPackage, start time.Time) {
+	updateState = poltroon.NewUpdateState(len(aurPkgs))
+	scheduler = poltroon.NewScheduler(aurPkgs)
+	fetchChan = make(chan *poltroon.AurPackage)
+	state := updateState
+	scheduler.OnSkip = func(pkg *poltroon.AurPackage, failed string) {
+		output(fmt.Sprintf("%s: skipping because %s failed", pkg.Name, failed))
+		state.Skipped(pkg, errors.Errorf("%s failed", failed))
+	}
+	buildCtx, stopClock := startBuildClock()
+	defer stopClock()
+	// Cancels what hasn't started when we are interrupted or out of
+	// time.  It only looks at this run, and is gone before we return.
+	done := make(chan struct{})
+	cancelled := make(chan struct{})
+	go func(sched *poltroon.Scheduler, state *poltroon.UpdateState) {
+		defer close(cancelled)
+		select {
+		case <-stopCtx.Done():
+		case <-buildCtx.Done():
+		case <-done:
+			return
 		}
-
-		updateState.Wait()
-
-		var good, bad []string
-		for _, pkg := range aurPkgs {
-			if len(pkg.PkgPaths) == 0 {
-				bad = append(bad, pkg.Name)
+		for _, pkg := range sched.Cancel() {
+			if totalTimeoutPassed(buildCtx) && stopCtx.Err() == nil {
+				markLimited(state, pkg, errors.Errorf("not started within the %s TotalTimeout", settings.TotalTimeout))
 			} else {
-				good = append(good, pkg.PkgPaths...)
+				state.Cancelled(pkg)
 			}
 		}
+	}(scheduler, updateState)
 
-		elapsed := time.Since(start)
+	rendered := make(chan struct{})
+	if settings.Quiet {
+		close(rendered)
+	} else {
+		events := updateState.Subscribe()
+		go func() {
+			poltroon.RenderText(os.Stdout, len(aurPkgs), events)
+			close(rendered)
+		}()
+	}
 
-		fmt.Println()
-		for _, b := range bad {
-			fmt.Printf("***Error processing %s***\n", b)
-		}
-		if len(bad) != 0 {
-			fmt.Println()
-		}
+	if !settings.NoReview && !settings.NoConfirm {
+		reviewChan = make(chan *poltroon.AurPackage, len(aurPkgs))
+		reviewStore = review.NewStore(path.Join(settings.CacheDir, "reviewed"))
+	}
+
+	// makepkg runs in the background, where sudo can't ask for a
+	// password, so we get one now and keep it fresh.
+	if err := backend.RefreshSudo(true); err != nil {
+		output(fmt.Sprintf("Warning: %v.  makepkg may be unable to install dependencies.", err))
+	}
+	sudoDone := make(chan struct{})
+	keepSudoFresh(backend, sudoDone)
+
+	// Start our asynchronous pipeline
+	startFetchers(backend, fetchChan, reviewChan, settings.Fetchers)
+	startMakers(backend, scheduler, buildCtx, settings.Makers)
 
-		if len(bad) == 0 && len(good) == 0 {
-			fmt.Printf("Found nothing to do in %s\n", elapsed)
+	// Push things into the pipeline here
+	for _, a := range aurPkgs {
+		fetchChan <- a
+	}
+	close(fetchChan)
+
+	var rejected map[string]bool
+	var reviewFailed map[string]error
+	if reviewChan != nil {
+		rejected, reviewFailed = reviewPackages(reviewStore, reviewChan)
+	}
+
+	updateState.Wait()
+	<-rendered
+	close(sudoDone)
+	close(done)
+	<-cancelled
+
+	skipped := scheduler.Skipped()
+	cancelledPkgs := scheduler.Cancelled()
+	var good []string
+	var bad []*poltroon.AurPackage
+	for _, pkg := range aurPkgs {
+		if len(pkg.PkgPaths) == 0 {
+			bad = append(bad, pkg)
 		} else {
-			fmt.Printf("Created %d packages in %s\n", len(good), elapsed)
+			good = append(good, pkg.PkgPaths...)
 		}
+	}
+
+	elapsed := time.Since(start)
 
-		if len(good) != 0 {
-			fmt.Printf("\nAfter you look in %s and verify it looks good, run:\n", root)
-			fmt.Printf("    sudo pacman -U --noconfirm %s\n", strings.Join(good, " "))
+	fmt.Println()
+	for _, b := range bad {
+		if reason, ok := limitedReason(b); ok {
+			fmt.Printf("***%s went over a limit: %s***\n", b.Name, reason)
+		} else if failed, ok := skipped[b.Name]; ok {
+			fmt.Printf("***Skipped %s because %s failed***\n", b.Name, failed)
+		} else if err, ok := reviewFailed[b.Name]; ok {
+			fmt.Printf("***Failed to review %s: %v***\n", b.Name, err)
+		} else if rejected[b.Name] {
+			fmt.Printf("***Did not make %s because it was not approved***\n", b.Name)
+		} else if cancelledPkgs[b.Name] {
+			fmt.Printf("***Cancelled %s***\n", b.Name)
+		} else {
+			fmt.Printf("***Error processing %s, see %s***\n", b.Name, b.Logs())
+		}
+	}
+	if len(bad) != 0 {
+		fmt.Println()
+	}
+	mismatched := false
+	for _, pkg := range aurPkgs {
+		for _, m := range pkg.Mismatches {
+			fmt.Printf("***%s was not what we expected: %s***\n", pkg.Name, m)
+			mismatched = true
 		}
-		fmt.Printf("\nTo clean up, run\n")
-		fmt.Printf("    rm -rf %s/*\n", root)
+	}
+	if mismatched {
+		fmt.Println()
+	}
+	if stopCtx.Err() != nil {
+		fmt.Printf("Interrupted, so %d packages were cancelled\n", len(cancelledPkgs))
+	}
 
-		return nil
+	if len(bad) == 0 && len(good) == 0 {
+		fmt.Printf("Found nothing to do in %s\n", elapsed)
+	} else {
+		fmt.Printf("Created %d packages in %s\n", len(good), elapsed)
 	}
 
-	app.Run(os.Args)
+	published := false
+	if len(good) != 0 && settings.RepoDir != "" {
+		if err := repo.New(settings.RepoDir, settings.RepoName).Add(good...); err != nil {
+			fmt.Printf("\n***Unable to add packages to the %s repository: %+v***\n", settings.RepoName, err)
+		} else {
+			published = true
+			fmt.Printf("\nAdded %d packages to the %s repository in %s.  To install them, run:\n", len(good), settings.RepoName, settings.RepoDir)
+			fmt.Printf("    sudo pacman -Syu\n")
+		}
+	}
+	if len(good) != 0 && !published {
+		fmt.Printf("\nAfter you look in %s and verify it looks good, run:\n", root)
+		fmt.Printf("    sudo pacman -U --noconfirm %s\n", strings.Join(good, " "))
+	}
+	fmt.Printf("\nMade packages are kept in %s, so they won't be made again.\n", root)
+	fmt.Printf("To free up space, run\n")
+	fmt.Printf("    poltroon clean --keep 1\n")
+
+	if len(bad) != 0 {
+		os.Exit(1)
+	}
 }
 
 func printAllLicenses() {
@@ -222,105 +510,364 @@ func PrintLicense(titleName, assetName string) {
 	fmt.Printf("LICENSE For %s:\n%s\n", titleName, license)
 }
 
-func startFetchers(e *exec.Exec, fetcherCnt int) {
+// startFetchers starts fetcherCnt fetchers, which fetch what comes in
+// on pkgs.  toReview, if there is one, is closed once they are done.
+// Both are passed in, rather than read from the globals, so that a
+// fetcher lingering after its run can't see the next one.
+func startFetchers(e exec.Builder, pkgs <-chan *poltroon.AurPackage, toReview chan *poltroon.AurPackage, fetcherCnt int) {
+	var wg sync.WaitGroup
+	wg.Add(fetcherCnt)
 	for i := 0; i < fetcherCnt; i++ {
 		go func() {
+			defer wg.Done()
 			// Fetch each package.  When we finish with a package we
 			// either pass it onto the next stage of the pipeline or
 			// we error mark it finished.
-			for pkg := range fetchChan {
+			for pkg := range pkgs {
 				fetchPackage(e, pkg)
 			}
 		}()
 	}
+	// Nothing more can need reviewing once the fetchers are done.
+	go func() {
+		wg.Wait()
+		if toReview != nil {
+			close(toReview)
+		}
+	}()
 }
 
-func fetchPackage(e *exec.Exec, pkg *poltroon.AurPackage) {
+func fetchPackage(e exec.Builder, pkg *poltroon.AurPackage) {
+	// If we already made this version, there is nothing to fetch or
+	// review.  A particular commit might not be what we made, though.
+	// Made can only fail on names that aren't valid glob patterns,
+	// which we can just go ahead and make.
+	if pkg.Commit == "" {
+		if made, _ := pkg.Made(); len(made) != 0 {
+			pkg.PkgPaths = made
+			// clean goes by when versions were last used.
+			now := time.Now()
+			os.Chtimes(pkg.Root, now, now)
+			output(fmt.Sprintf("%s: already made %s, not making it again", pkg.Name, pkg.NextVersion))
+			scheduler.Fetched(pkg)
+			return
+		}
+	}
+
+	updateState.FetchStarted(pkg)
 	var err error
 	defer func() {
 		if err != nil {
-			output(fmt.Sprintf("%s: failed to fetch due to %+v", pkg.Name, err))
-			updateState.Finished(pkg.Name)
+			if scheduler.Failed(pkg) {
+				output(fmt.Sprintf("%s: failed to fetch due to %+v", pkg.Name, err))
+				updateState.FetchFailed(pkg, err)
+			}
 			return
 		}
-		makeChan <- pkg
+		if reviewChan != nil {
+			reviewChan <- pkg
+		} else {
+			scheduler.Fetched(pkg)
+		}
 	}()
 
+	// Don't clean out the directory of something we won't make.
+	if err = stopCtx.Err(); err != nil {
+		return
+	}
 	err = pkg.PreparePackageDir(dirMode)
 	if err != nil {
 		return
 	}
 
-	resp, err := http.Get(pkg.SnapshotURL)
+	if settings.Git && !strings.HasPrefix(pkg.SnapshotURL, fileScheme) {
+		err = checkoutPackage(pkg)
+	} else {
+		err = extractSnapshot(pkg)
+	}
+	if err == nil {
+		err = checkSrcInfo(pkg)
+	}
+}
+
+func extractSnapshot(pkg *poltroon.AurPackage) error {
+	snapshot, err := openSnapshot(pkg.SnapshotURL)
 	if err != nil {
-		err = errors.Wrapf(err, "%s: fetching %s", pkg.Name, pkg.SnapshotURL)
-		return
+		return errors.Wrapf(err, "%s: fetching", pkg.Name)
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		err = errors.Errorf("%s: fetching %s unexpected status %d/%s", pkg.Name, pkg.SnapshotURL, resp.StatusCode, resp.Status)
-		return
+	defer snapshot.Close()
+
+	if err = tar.ExtractArchive(snapshot, pkg.Build()); err != nil {
+		return errors.Wrapf(err, "%s: extracting", pkg.Name)
 	}
+	return nil
+}
 
-	ungzipper, err := gzip.NewReader(resp.Body)
+// checkSrcInfo makes sure the package base still makes every package
+// we want from it.  Packages without a .SRCINFO, such as some local
+// archives, aren't checked.
+func checkSrcInfo(pkg *poltroon.AurPackage) error {
+	name := path.Join(pkg.Build(), pkg.Base(), ".SRCINFO")
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return nil
+	}
+	s, err := srcinfo.ParseFile(name)
 	if err != nil {
-		err = errors.Wrapf(err, "%s: decompressing", pkg.Name)
+		return err
+	}
+	for _, n := range pkg.Wanted() {
+		if s.Package(n) == nil {
+			return errors.Errorf("%s no longer makes %s, only %s", s.Base, n, strings.Join(s.Names(), ", "))
+		}
+	}
+	return nil
+}
+
+// checkUpstream remembers where the version control sources in pkg's
+// .SRCINFO are, so --devel can tell when they change.  It contacts
+// whatever the .SRCINFO names, through e, so it must only be called
+// once pkg has been approved.
+func checkUpstream(e exec.Builder, pkg *poltroon.AurPackage) {
+	name := path.Join(pkg.Build(), pkg.Base(), ".SRCINFO")
+	if _, err := os.Stat(name); os.IsNotExist(err) {
 		return
 	}
-	err = tar.ExtractAll(ungzipper, pkg.Build())
+	s, err := srcinfo.ParseFile(name)
+	if err == nil {
+		pkg.Revisions, err = vcs.Current(stopCtx, e.UpstreamCommand, s.Sources(srcinfo.HostArch()))
+	}
 	if err != nil {
-		err = errors.Wrapf(err, "%s: extracting", pkg.Name)
-		return
+		output(fmt.Sprintf("%s: warning: unable to check upstream sources due to %v", pkg.Name, err))
+	}
+}
+
+// gitLocks keeps split packages that share a git repository from
+// syncing it at the same time.
+var gitLocks = struct {
+	sync.Mutex
+	byBase map[string]*sync.Mutex
+}{byBase: map[string]*sync.Mutex{}}
+
+func lockGitRepo(base string) *sync.Mutex {
+	gitLocks.Lock()
+	defer gitLocks.Unlock()
+	m, ok := gitLocks.byBase[base]
+	if !ok {
+		m = &sync.Mutex{}
+		gitLocks.byBase[base] = m
+	}
+	m.Lock()
+	return m
+}
+
+// checkoutPackage brings our clone of the package's git repository up
+// to date and writes the files from pkg.Commit (or the newest commit,
+// which is then recorded in pkg.Commit) into the build directory.
+func checkoutPackage(pkg *poltroon.AurPackage) error {
+	m := lockGitRepo(pkg.Base())
+	defer m.Unlock()
+
+	dir := path.Join(settings.CacheDir, "git", pkg.Base())
+	if err := os.MkdirAll(path.Dir(dir), dirMode); err != nil {
+		return err
+	}
+	clone, err := git.Sync(stopCtx, settings.GitRepoURL(pkg.Base()), dir)
+	if err != nil {
+		return errors.Wrapf(err, "%s: fetching", pkg.Name)
+	}
+	commit, err := clone.Resolve(stopCtx, pkg.Commit)
+	if err != nil {
+		return errors.Wrapf(err, "%s: checking out", pkg.Name)
+	}
+	pkg.Commit = commit
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(clone.Archive(stopCtx, commit, pkg.Base()+"/", w))
+	}()
+	defer r.Close()
+	if err = tar.ExtractAll(r, pkg.Build()); err != nil {
+		return errors.Wrapf(err, "%s: checking out %s", pkg.Name, commit)
+	}
+	return nil
+}
+
+// openSnapshot opens a package archive, either from the AUR or, for
+// file:// urls, from the local disk.
+func openSnapshot(snapshotURL string) (io.ReadCloser, error) {
+	if strings.HasPrefix(snapshotURL, fileScheme) {
+		return os.Open(strings.TrimPrefix(snapshotURL, fileScheme))
+	}
+	resp, err := aurClient.Get(stopCtx, snapshotURL)
+	if err != nil {
+		return nil, err
 	}
+	return resp.Body, nil
 }
 
-func startMakers(e *exec.Exec, makerCnt int, skipPgpCheck bool) {
+// startMakers starts makerCnt makers, which make packages in buildCtx
+// as sched releases them.
+func startMakers(e exec.Builder, sched *poltroon.Scheduler, buildCtx context.Context, makerCnt int) {
 	for i := 0; i < makerCnt; i++ {
 		go func() {
-			for pkg := range makeChan {
-				makePackage(e, skipPgpCheck, pkg)
+			for pkg := range sched.Ready() {
+				makePackage(e, buildCtx, settings.SkipPgpCheckFor(pkg.Name), settings.LimitsFor(pkg.Name), pkg)
 			}
 		}()
 	}
 }
 
-func makePackage(e *exec.Exec, skipPgpCheck bool, pkg *poltroon.AurPackage) {
-	updateState.StartMake(pkg.Name)
-	defer updateState.Finished(pkg.Name)
+func makePackage(e exec.Builder, buildCtx context.Context, skipPgpCheck bool, limits conf.Limits, pkg *poltroon.AurPackage) {
+	// Cancelled while waiting for a maker.  Whoever cancelled it
+	// already reported it.
+	if !scheduler.Start(pkg) {
+		return
+	}
+	if stopCtx.Err() != nil {
+		scheduler.Interrupted(pkg)
+		updateState.Cancelled(pkg)
+		return
+	}
+	updateState.MakeStarted(pkg)
 
-	err := e.Make(pkg, skipPgpCheck)
+	// PkgPaths is already set if an earlier run made this version.
+	reused := len(pkg.PkgPaths) != 0
+	if !reused {
+		if settings.Devel {
+			checkUpstream(e, pkg)
+		}
+		ctx := buildCtx
+		if limits.BuildTimeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(buildCtx, limits.BuildTimeout)
+			defer cancel()
+		}
+		err := e.Make(ctx, pkg, skipPgpCheck, exec.Limits{Memory: limits.MemoryLimit, CPUs: limits.CPUs})
+		if err != nil && killCtx.Err() != nil {
+			output(fmt.Sprintf("%s: make cancelled", pkg.Name))
+			scheduler.Interrupted(pkg)
+			updateState.Cancelled(pkg)
+			return
+		}
+		if limitErr := overLimit(err, buildCtx, ctx, limits.BuildTimeout); limitErr != nil {
+			output(fmt.Sprintf("%s: stopped because it %v", pkg.Name, limitErr))
+			scheduler.Failed(pkg)
+			markLimited(updateState, pkg, limitErr)
+			return
+		}
+		if err != nil {
+			output(fmt.Sprintf("%s: failed to make due to %+v", pkg.Name, err))
+			scheduler.Failed(pkg)
+			updateState.MakeFailed(pkg, err)
+			return
+		}
+	}
+	made, err := pkgfile.ReadAll(pkg.PkgPaths)
 	if err != nil {
-		output(fmt.Sprintf("%s: failed to make due to %+v", pkg.Name, err))
+		output(fmt.Sprintf("%s: failed to read what was made due to %+v", pkg.Name, err))
+		pkg.PkgPaths = nil
+		scheduler.Failed(pkg)
+		updateState.MakeFailed(pkg, err)
 		return
 	}
+	version := pkg.NextVersion
+	if pkg.Devel {
+		version = ""
+	}
+	pkg.Mismatches = pkgfile.Check(made, pkg.Wanted(), pkg.PackageBase, version)
+	for _, m := range pkg.Mismatches {
+		output(fmt.Sprintf("%s: warning: %s", pkg.Name, m))
+	}
+	// Other packages from a split package base are made too, but we
+	// only install the ones that were wanted.
+	if wanted := wantedPaths(made, pkg.Wanted()); len(wanted) != 0 {
+		pkg.PkgPaths = wanted
+	}
+	// Packages that others depend on have to be installed before
+	// those others can be made.
+	if scheduler.HasDependents(pkg) {
+		if err := e.Install(pkg); err != nil {
+			output(fmt.Sprintf("%s: failed to install due to %+v", pkg.Name, err))
+			pkg.PkgPaths = nil
+			scheduler.Failed(pkg)
+			updateState.MakeFailed(pkg, err)
+			return
+		}
+	}
+	if reviewStore != nil && !reused {
+		if err := reviewStore.Save(pkg.Name, pkg.Reviewed()); err != nil {
+			output(fmt.Sprintf("%s: failed to save reviewed files due to %+v", pkg.Name, err))
+		}
+	}
+	if len(pkg.Revisions) != 0 {
+		if err := vcsStore.Set(pkg.Wanted(), pkg.Revisions); err != nil {
+			output(fmt.Sprintf("%s: failed to record upstream revisions due to %+v", pkg.Name, err))
+		}
+	}
+	scheduler.Succeeded(pkg)
+	updateState.MakeSucceeded(pkg)
 }
 
-func fetchNamedPkgs(names []string, root string) ([]*poltroon.AurPackage, error) {
-	allInfos, err := aur.GetInfos(names)
+// wantedPaths returns the paths of the packages in made that are
+// called one of names.
+func wantedPaths(made []*pkgfile.Package, names []string) []string {
+	var result []string
+	for _, m := range made {
+		for _, n := range names {
+			if m.Info.Name == n {
+				result = append(result, m.Path)
+			}
+		}
+	}
+	return result
+}
+
+// fetchNamedPkgs looks up the named packages.  A name may be followed
+// by @commit to build that commit of the package, when building from
+// git.
+func fetchNamedPkgs(args []string, root string) ([]*poltroon.AurPackage, error) {
+	names := make([]string, len(args))
+	commits := make([]string, len(args))
+	for i, a := range args {
+		names[i] = a
+		if at := strings.Index(a, "@"); at != -1 {
+			if !settings.Git {
+				return nil, errors.Errorf("%s: choosing a commit only works with --git", a)
+			}
+			names[i], commits[i] = a[:at], a[at+1:]
+		}
+	}
+	allInfos, err := aurClient.GetInfos(stopCtx, names)
 	if err != nil {
 		fatal(fmt.Sprintf("%+v: Get aur info for names", err))
 	}
 	result := []*poltroon.AurPackage{}
 	missing := []string{}
-	for _, n := range names {
+	for i, n := range names {
 		info, ok := allInfos[n]
 		if !ok {
 			missing = append(missing, n)
 			continue
 		}
 		pkg := poltroon.NewAurPackage(root, n, "", info.Version, info.SnapshotURL)
+		pkg.PackageBase = info.PackageBase
+		pkg.Commit = commits[i]
 		result = append(result, pkg)
 	}
 	if len(missing) > 0 {
 		return nil, errors.Errorf("Could not find AUR entries for %q", strings.Join(missing, ", "))
 	}
-	return result, nil
+	// Split packages from the same base are made together.
+	return poltroon.GroupByBase(result), nil
 }
 
-func fetchChangedPkgs(e *exec.Exec, root string) ([]*poltroon.AurPackage, error) {
-	foreign, err := e.QueryForeignPackages()
+// fetchChangedPkgs returns the foreign packages with newer versions
+// in the AUR, split into the ones to update and the ones ignore says
+// to leave alone.
+func fetchChangedPkgs(e exec.Builder, db *pacdb.DB, root string, ignore *poltroon.IgnoreList) (updates, ignored []*poltroon.AurPackage, err error) {
+	foreign, err := db.Foreign()
 	if err != nil {
-		return nil, errors.Wrap(err, "queryUpdates")
+		return nil, nil, errors.Wrap(err, "queryUpdates")
 	}
 
 	names := []string{}
@@ -328,20 +875,109 @@ func fetchChangedPkgs(e *exec.Exec, root string) ([]*poltroon.AurPackage, error)
 		names = append(names, f.Name)
 	}
 
-	allInfos, err := aur.GetInfos(names)
+	allInfos, err := aurClient.GetInfos(stopCtx, names)
 	if err != nil {
 		fatal(fmt.Sprintf("%+v: Get aur info for names", err))
 	}
 
-	result := []*poltroon.AurPackage{}
+	updates = []*poltroon.AurPackage{}
+	var untracked []string
 	for _, f := range foreign {
 		info, ok := allInfos[f.Name]
-		if ok && alpm.Less(f.Version, info.Version) {
-			pkg := poltroon.NewAurPackage(root, f.Name, f.Version, info.Version, info.SnapshotURL)
-			result = append(result, pkg)
+		if !ok {
+			continue
+		}
+		devel := false
+		if !alpm.Less(f.Version, info.Version) {
+			if !settings.Devel {
+				continue
+			}
+			changed, tracked := upstreamChanged(e, f.Name)
+			if !tracked && isDevelName(f.Name) {
+				untracked = append(untracked, f.Name)
+			}
+			if !changed {
+				continue
+			}
+			devel = true
+		}
+		pkg := poltroon.NewAurPackage(root, f.Name, f.Version, info.Version, info.SnapshotURL)
+		pkg.PackageBase = info.PackageBase
+		pkg.Devel = devel
+		if ignore.Ignored(f.Name, f.Groups) {
+			ignored = append(ignored, pkg)
+		} else {
+			updates = append(updates, pkg)
+		}
+	}
+	if len(untracked) != 0 {
+		fmt.Printf("Not checking upstream sources of %s, since poltroon hasn't made them yet.\n\n", strings.Join(untracked, ", "))
+	}
+	return poltroon.GroupByBase(updates), ignored, nil
+}
+
+// upstreamChanged says whether the version control sources of the
+// named package have changed since we last made it.  tracked is false
+// if we don't know what it was made from.
+func upstreamChanged(e exec.Builder, name string) (changed, tracked bool) {
+	revs, err := vcsStore.Get(name)
+	if err == nil && len(revs) == 0 {
+		return false, false
+	}
+	var sources []string
+	if err == nil {
+		sources, err = vcs.Changed(stopCtx, e.UpstreamCommand, revs)
+	}
+	if err != nil {
+		output(fmt.Sprintf("%s: warning: unable to check upstream sources due to %v", name, err))
+		return false, true
+	}
+	return len(sources) != 0, true
+}
+
+var develSuffixes = []string{"-git", "-svn", "-hg", "-bzr", "-cvs", "-darcs"}
+
+// isDevelName guesses from its name whether a package is made from
+// version control sources.
+func isDevelName(name string) bool {
+	for _, s := range develSuffixes {
+		if strings.HasSuffix(name, s) {
+			return true
 		}
 	}
-	return result, nil
+	return false
+}
+
+// getIgnoreList combines the ignore settings from pacman.conf with
+// our own.
+func getIgnoreList() (*poltroon.IgnoreList, error) {
+	ignore := &poltroon.IgnoreList{}
+
+	pc, err := conf.ReadPacmanConf(settings.PacmanConf)
+	if err != nil {
+		return nil, err
+	}
+	ignore.Add(pc.IgnorePkg, pc.IgnoreGroup)
+	ignore.Add(settings.IgnorePkg, settings.IgnoreGroup)
+	return ignore, nil
+}
+
+// resolveDeps adds any AUR packages that pkgs depend on and returns
+// everything in build order.  Exits if some dependency cannot be
+// found anywhere.
+func resolveDeps(e exec.PackageQuerier, root string, pkgs []*poltroon.AurPackage) []*poltroon.AurPackage {
+	r := &resolve.Resolver{Infos: aurClient, Repo: e, Root: root}
+	plan, err := r.Resolve(stopCtx, pkgs)
+	if err != nil {
+		fatal(fmt.Sprintf("%+v: resolving dependencies", err))
+	}
+	if len(plan.Missing) != 0 {
+		fatal(fmt.Sprintf("Unable to find these dependencies in the repositories or the AUR: %s", strings.Join(plan.Missing, ", ")))
+	}
+	if added := len(plan.Packages) - len(pkgs); added > 0 {
+		fmt.Printf("Adding %d AUR dependencies\n", added)
+	}
+	return plan.Packages
 }
 
 var outputMutex sync.Mutex
@@ -358,23 +994,113 @@ func fatal(v ...interface{}) {
 }
 
 func getRoot() (string, error) {
-	root := path.Join(os.TempDir(), "poltroon")
+	root := settings.PackageRoot()
 	err := os.MkdirAll(root, dirMode)
 	return root, err
 }
 
-func askForConfirmation(s string) bool {
-	reader := bufio.NewReader(os.Stdin)
+// findBackend returns what answers questions about packages and what
+// makes them.  Tests replace it with one returning an *exec.Fake.
+var findBackend = func() (exec.PackageQuerier, exec.Builder, error) {
+	e, err := findExec()
+	if err != nil {
+		return nil, nil, err
+	}
+	builder, err := findBuilder(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, builder, nil
+}
 
+// findExec finds pacman and makepkg, and sets up a sandbox for
+// makepkg if the settings ask for one.
+func findExec() (*exec.Exec, error) {
+	e, err := exec.Find()
+	if err != nil {
+		return nil, err
+	}
+	if settings.Sandbox || settings.SandboxOffline {
+		e.Sandbox, err = exec.NewSandbox(settings.SandboxOffline)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// A clean root only gets the AUR packages we make or reuse.
+	e.SyncOnly = settings.Chroot
+	return e, nil
+}
+
+// findBuilder returns what makes packages: e, unless the settings ask
+// for a clean chroot.
+func findBuilder(e *exec.Exec) (exec.Builder, error) {
+	if !settings.Chroot {
+		return e, nil
+	}
+	var maker exec.RootMaker = &exec.Pacstrap{PacmanConf: settings.PacmanConf}
+	if settings.ChrootTarball != "" {
+		maker = &exec.Tarball{Path: settings.ChrootTarball}
+	}
+	return exec.NewChroot(path.Join(settings.CacheDir, "chroot"), maker)
+}
+
+// keepSudoFresh refreshes the sudo credentials every minute, without
+// prompting, until done is closed.
+func keepSudoFresh(e exec.Builder, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				e.RefreshSudo(false)
+			}
+		}
+	}()
+}
+
+type stdinLine struct {
+	line string
+	err  error
+}
+
+var (
+	stdinReader = bufio.NewReader(os.Stdin)
+	// Delivers the answer to a question that was abandoned because
+	// its context was cancelled, so that it isn't lost.  Only touched
+	// by askForConfirmation.
+	pendingLine chan stdinLine
+)
+
+// askForConfirmation returns false without waiting for an answer if
+// ctx is cancelled.  Only one line is read per question, so that
+// nothing else wanting the terminal, such as sudo, loses its input.
+func askForConfirmation(ctx context.Context, s string) bool {
 	for {
 		fmt.Printf("%s [y/N]: ", s)
 
-		response, err := reader.ReadString('\n')
-		if err != nil {
-			log.Fatal(err)
+		if pendingLine == nil {
+			pendingLine = make(chan stdinLine, 1)
+			go func(c chan<- stdinLine) {
+				line, err := stdinReader.ReadString('\n')
+				c <- stdinLine{line, err}
+			}(pendingLine)
+		}
+		var in stdinLine
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return false
+		case in = <-pendingLine:
+			pendingLine = nil
+		}
+		if in.err != nil {
+			log.Fatal(in.err)
 		}
 
-		response = strings.ToLower(strings.TrimSpace(response))
+		response := strings.ToLower(strings.TrimSpace(in.line))
 
 		if response == "y" || response == "yes" {
 			return true
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/review"
+	"github.com/pkg/errors"
+)
+
+// reviewPackages shows the user what changed in each package as it
+// is fetched and asks whether to make it.  Approved packages are
+// handed to the scheduler only once everything has been reviewed, so
+// that progress output doesn't get mixed up with the review.
+// Returns the names of the packages that were not approved, and why
+// reviewing the ones that couldn't be reviewed failed.
+func reviewPackages(store *review.Store, fetched <-chan *poltroon.AurPackage) (rejected map[string]bool, failed map[string]error) {
+	var approved []*poltroon.AurPackage
+	rejected = map[string]bool{}
+	failed = map[string]error{}
+	for pkg := range fetched {
+		if stopCtx.Err() != nil {
+			// Already cancelled by the scheduler
+			continue
+		}
+		ok, err := reviewPackage(store, pkg)
+		if err != nil {
+			output(fmt.Sprintf("%s: failed to review due to %+v", pkg.Name, err))
+			failed[pkg.Name] = err
+			if scheduler.Failed(pkg) {
+				updateState.FetchFailed(pkg, errors.Wrap(err, "reviewing"))
+			}
+			continue
+		}
+		if ok {
+			approved = append(approved, pkg)
+			continue
+		}
+		if stopCtx.Err() != nil {
+			continue
+		}
+		rejected[pkg.Name] = true
+		if scheduler.Failed(pkg) {
+			updateState.Skipped(pkg, errors.New("not approved"))
+		}
+	}
+	for _, pkg := range approved {
+		scheduler.Fetched(pkg)
+	}
+	return rejected, failed
+}
+
+// reviewPackage shows the changes to one package since it was last
+// built, or all of its files if it hasn't been built before, and asks
+// the user to approve it.  If they do, a copy of the files is kept in
+// pkg.Reviewed() so it can be saved once the make succeeds.
+func reviewPackage(store *review.Store, pkg *poltroon.AurPackage) (bool, error) {
+	dir := path.Join(pkg.Build(), pkg.Base())
+	diff, err := store.Diff(pkg.Name, dir)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Println()
+	switch {
+	case len(diff) == 0:
+		fmt.Printf("%s: no changes since it was last built\n", pkg)
+	case store.Has(pkg.Name):
+		header := fmt.Sprintf("%s: changes since it was last built\n\n", pkg)
+		page(append([]byte(header), diff...))
+	default:
+		header := fmt.Sprintf("%s: never built before, showing every file\n\n", pkg)
+		page(append([]byte(header), diff...))
+	}
+
+	if !askForConfirmation(stopCtx, fmt.Sprintf("Make %s?", pkg.Name)) {
+		return false, nil
+	}
+	if err = os.RemoveAll(pkg.Reviewed()); err != nil {
+		return false, errors.Wrapf(err, "cleaning %s", pkg.Reviewed())
+	}
+	if err = review.Copy(dir, pkg.Reviewed()); err != nil {
+		return false, errors.Wrapf(err, "keeping reviewed copy of %s", pkg.Name)
+	}
+	return true, nil
+}
+
+// page shows text through $PAGER, defaulting to less.  If the pager
+// can't be run, the text is printed directly.
+func page(text []byte) {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = bytes.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Stdout.Write(text)
+	}
+}
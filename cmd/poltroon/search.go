@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ginabythebay/alpm"
+	"github.com/ginabythebay/poltroon/aur"
+	"github.com/urfave/cli"
+)
+
+var searchCommand = cli.Command{
+	Name:      "search",
+	Usage:     "Search the AUR, most popular packages first",
+	ArgsUsage: "term",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "by",
+			Value: string(aur.ByNameDesc),
+			Usage: fmt.Sprintf("Field to search, one of %v", aur.AllBy),
+		},
+	},
+	Action: searchAction,
+}
+
+func searchAction(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		fmt.Println("search takes exactly one search term")
+		os.Exit(1)
+	}
+	by, err := aur.ParseBy(c.String("by"))
+	if err != nil {
+		fatal(err)
+	}
+
+	foreign, err := pacmanDB.Foreign()
+	if err != nil {
+		fatal(err)
+	}
+	installed := map[string]string{}
+	for _, f := range foreign {
+		installed[f.Name] = f.Version
+	}
+
+	infos, err := aurClient.Search(context.Background(), c.Args().First(), by)
+	if err != nil {
+		fatal(fmt.Sprintf("%+v: searching aur", err))
+	}
+	sort.Sort(byPopularity(infos))
+	for _, info := range infos {
+		fmt.Println(searchLine(info, installed))
+		if info.Description != "" {
+			fmt.Printf("    %s\n", info.Description)
+		}
+	}
+	return nil
+}
+
+// searchLine formats a single search result, marking packages that
+// are installed, and if the installed version is older, what it is.
+func searchLine(info *aur.PkgInfo, installed map[string]string) string {
+	parts := []string{
+		fmt.Sprintf("aur/%s %s (+%d %.2f)", info.Name, info.Version, info.NumVotes, info.Popularity),
+	}
+	if info.IsOutOfDate() {
+		parts = append(parts, "(Out-of-date)")
+	}
+	if version, ok := installed[info.Name]; ok {
+		if alpm.Less(version, info.Version) {
+			parts = append(parts, fmt.Sprintf("[installed: %s]", version))
+		} else {
+			parts = append(parts, "[installed]")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Sorts by popularity, then votes, then name, most popular first.
+type byPopularity []*aur.PkgInfo
+
+func (s byPopularity) Len() int      { return len(s) }
+func (s byPopularity) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPopularity) Less(i, j int) bool {
+	if s[i].Popularity != s[j].Popularity {
+		return s[i].Popularity > s[j].Popularity
+	}
+	if s[i].NumVotes != s[j].NumVotes {
+		return s[i].NumVotes > s[j].NumVotes
+	}
+	return s[i].Name < s[j].Name
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	// stopCtx is cancelled by the first interrupt.  Nothing new is
+	// started after that, and fetches are abandoned.
+	stopCtx = context.Background()
+	// killCtx is cancelled by the second interrupt, which stops any
+	// makes that are still running.
+	killCtx = context.Background()
+)
+
+// watchSignals sets up stopCtx and killCtx to be cancelled by SIGINT
+// and SIGTERM.
+func watchSignals() {
+	var stop, kill context.CancelFunc
+	stopCtx, stop = context.WithCancel(context.Background())
+	killCtx, kill = context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		output("\nInterrupted: not starting anything new and waiting for running makes.  Interrupt again to stop them.")
+		stop()
+		<-sigs
+		output("\nInterrupted again: stopping running makes.")
+		kill()
+	}()
+}
@@ -0,0 +1,184 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "poltroon_conf_test")
+	ok(t, err)
+	for name, contents := range files {
+		p := path.Join(dir, name)
+		ok(t, os.MkdirAll(path.Dir(p), 0755))
+		ok(t, ioutil.WriteFile(p, []byte(strings.Replace(contents, "{dir}", dir, -1)), 0644))
+	}
+	return dir
+}
+
+func TestReadPacmanConf(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"pacman.conf": `
+# comment
+[options]
+HoldPkg     = pacman glibc
+IgnorePkg   = foo bar # trailing comment
+IgnoreGroup = kde
+CheckSpace
+Include = {dir}/pacman.d/*.conf
+
+[core]
+Include = {dir}/mirrorlist
+`,
+		"pacman.d/ignore.conf": "IgnorePkg = baz\n",
+		"mirrorlist":           "Server = https://example.com/$repo/os/$arch\n",
+	})
+	defer os.RemoveAll(dir)
+
+	pc, err := ReadPacmanConf(path.Join(dir, "pacman.conf"))
+	ok(t, err)
+	equals(t, &PacmanConf{
+		IgnorePkg:   []string{"foo", "bar", "baz"},
+		IgnoreGroup: []string{"kde"},
+	}, pc)
+
+	f, err := ParseFile(path.Join(dir, "pacman.conf"))
+	ok(t, err)
+	options := f.Section("options")
+	_, found := options.Last("CheckSpace")
+	assert(t, found, "expected to find CheckSpace")
+	equals(t, []string{"https://example.com/$repo/os/$arch"}, f.Section("core").Values("Server"))
+	assert(t, f.Section("extra") == nil, "expected no extra section")
+}
+
+func TestParseErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"nosection.conf": "IgnorePkg = foo\n",
+		"badheader.conf": "[options\n",
+		"loop.conf":      "[options]\nInclude = {dir}/loop.conf\n",
+	})
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"nosection.conf", "badheader.conf", "loop.conf"} {
+		_, err := ParseFile(path.Join(dir, name))
+		assert(t, err != nil, "expected an error for %s", name)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"poltroon.conf": `
+[options]
+IgnorePkg = foo
+IgnorePkg = bar
+Makers = 5
+NoConfirm
+Quiet = false
+BuildRoot = /var/tmp/poltroon
+Git
+Devel
+GitURL = /srv/aur/
+SandboxOffline
+Chroot
+ChrootTarball = /srv/root.tar.zst
+RepoDir = /srv/repo
+TotalTimeout = 3h
+BuildTimeout = 45m
+MemoryLimit = 4G
+
+[pkg baz]
+SkipPgpCheck
+BuildTimeout = 2h
+CPUs = 1.5
+`,
+		"bad.conf":     "[options]\nMakers = lots\n",
+		"unknown.conf": "[options]\nColor\n",
+		"size.conf":    "[options]\nMemoryLimit = lots\n",
+		"timeout.conf": "[pkg baz]\nBuildTimeout = 45\n",
+	})
+	defer os.RemoveAll(dir)
+
+	c, err := ReadConfig(path.Join(dir, "poltroon.conf"))
+	ok(t, err)
+	expected := Default()
+	expected.IgnorePkg = []string{"foo", "bar"}
+	expected.Makers = 5
+	expected.NoConfirm = true
+	expected.BuildRoot = "/var/tmp/poltroon"
+	expected.Git = true
+	expected.Devel = true
+	expected.GitURL = "/srv/aur/"
+	expected.SandboxOffline = true
+	expected.Chroot = true
+	expected.ChrootTarball = "/srv/root.tar.zst"
+	expected.RepoDir = "/srv/repo"
+	expected.TotalTimeout = 3 * time.Hour
+	expected.Limits = Limits{BuildTimeout: 45 * time.Minute, MemoryLimit: 4 << 30}
+	expected.Packages["baz"] = &PackageConfig{
+		SkipPgpCheck: true,
+		Limits:       Limits{BuildTimeout: 2 * time.Hour, CPUs: 1.5},
+	}
+	equals(t, expected, c)
+	assert(t, c.SkipPgpCheckFor("baz"), "expected to skip pgp check for baz")
+	assert(t, !c.SkipPgpCheckFor("foo"), "expected not to skip pgp check for foo")
+	equals(t, Limits{BuildTimeout: 2 * time.Hour, MemoryLimit: 4 << 30, CPUs: 1.5}, c.LimitsFor("baz"))
+	equals(t, c.Limits, c.LimitsFor("foo"))
+	equals(t, "/srv/aur/baz.git", c.GitRepoURL("baz"))
+	equals(t, "/var/tmp/poltroon", c.PackageRoot())
+	equals(t, path.Join(Default().CacheDir, "packages"), Default().PackageRoot())
+	equals(t, "https://aur.archlinux.org/baz.git", Default().GitRepoURL("baz"))
+
+	// What we write, we can read back.
+	var buf bytes.Buffer
+	ok(t, c.Write(&buf))
+	written := path.Join(dir, "written.conf")
+	ok(t, ioutil.WriteFile(written, buf.Bytes(), 0644))
+	reread, err := ReadConfig(written)
+	ok(t, err)
+	equals(t, c, reread)
+
+	c, err = ReadConfig(path.Join(dir, "missing.conf"))
+	ok(t, err)
+	equals(t, Default(), c)
+
+	for _, name := range []string{"bad.conf", "unknown.conf", "size.conf", "timeout.conf"} {
+		_, err = ReadConfig(path.Join(dir, name))
+		assert(t, err != nil, "expected an error for %s", name)
+	}
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,433 @@
+package conf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ginabythebay/poltroon/aur"
+	"github.com/ginabythebay/poltroon/pacdb"
+	"github.com/pkg/errors"
+)
+
+// Config holds poltroon settings.  The config file looks like
+//
+//	[options]
+//	Makers = 4
+//	BuildRoot = /var/tmp/poltroon
+//	CacheDir = /var/cache/poltroon
+//	IgnorePkg = foo bar
+//	NoConfirm
+//
+//	[pkg baz]
+//	SkipPgpCheck
+//	BuildTimeout = 2h
+//
+// Boolean settings may be given bare, as pacman.conf does, or as
+// Key = true/false.  Durations look like 90m and sizes like 4G.  Keys
+// are the same as the field names below.
+type Config struct {
+	Fetchers       int
+	Makers         int
+	SkipPgpCheck   bool
+	NoConfirm      bool
+	Quiet          bool
+	NoReview       bool
+	BuildRoot      string
+	CacheDir       string
+	AurURL         string
+	Git            bool
+	Devel          bool
+	GitURL         string
+	Sandbox        bool
+	SandboxOffline bool
+	Chroot         bool
+	ChrootTarball  string
+	DBPath         string
+	PacmanConf     string
+	RepoDir        string
+	RepoName       string
+	IgnorePkg      []string
+	IgnoreGroup    []string
+	// TotalTimeout is how long making everything may take.  Zero
+	// means no limit.
+	TotalTimeout time.Duration
+	// Limits applies to every package, unless overridden in its
+	// section.
+	Limits
+
+	// Packages holds overrides from [pkg name] sections, keyed by
+	// package name.
+	Packages map[string]*PackageConfig
+}
+
+// PackageConfig holds settings that apply to a single package.
+type PackageConfig struct {
+	// SkipPgpCheck turns off pgp checks for just this package.
+	SkipPgpCheck bool
+	// Limits, where set, override the ones in [options].
+	Limits
+}
+
+// Limits bound what making a single package may use.  Zero means no
+// limit.
+type Limits struct {
+	// BuildTimeout is how long makepkg may run for.
+	BuildTimeout time.Duration
+	// MemoryLimit is in bytes.
+	MemoryLimit int64
+	// CPUs is how many CPUs worth of time makepkg may use.
+	CPUs float64
+}
+
+// Prefix of section names holding per-package settings.
+const pkgSectionPrefix = "pkg "
+
+// Default returns the settings used when nothing else says otherwise.
+func Default() *Config {
+	return &Config{
+		Fetchers:   2,
+		Makers:     3,
+		CacheDir:   defaultCacheDir(),
+		AurURL:     aur.DefaultURL,
+		DBPath:     pacdb.DefaultDBPath,
+		PacmanConf: DefaultPacmanConf,
+		RepoName:   "poltroon",
+		Packages:   map[string]*PackageConfig{},
+	}
+}
+
+// DefaultConfigPath returns $XDG_CONFIG_HOME/poltroon/poltroon.conf,
+// falling back to ~/.config if XDG_CONFIG_HOME isn't set.
+func DefaultConfigPath() string {
+	base := os.Getenv("XDG_CONFIG_HOME")
+	if base == "" {
+		base = path.Join(os.Getenv("HOME"), ".config")
+	}
+	return path.Join(base, "poltroon", "poltroon.conf")
+}
+
+// defaultCacheDir returns $XDG_CACHE_HOME/poltroon, falling back to
+// ~/.cache if XDG_CACHE_HOME isn't set.
+func defaultCacheDir() string {
+	base := os.Getenv("XDG_CACHE_HOME")
+	if base == "" {
+		base = path.Join(os.Getenv("HOME"), ".cache")
+	}
+	return path.Join(base, "poltroon")
+}
+
+// ReadConfig reads the poltroon config file at name, on top of
+// Default().  A missing file is not an error; it results in the
+// defaults.
+func ReadConfig(name string) (*Config, error) {
+	result := Default()
+	f, err := ParseFile(name)
+	if os.IsNotExist(errors.Cause(err)) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	for _, s := range f.Sections {
+		switch {
+		case s.Name == "options":
+			err = result.setOptions(s)
+		case strings.HasPrefix(s.Name, pkgSectionPrefix):
+			pkgName := strings.TrimSpace(strings.TrimPrefix(s.Name, pkgSectionPrefix))
+			err = result.Package(pkgName).set(s)
+		default:
+			err = errors.Errorf("%s: unknown section [%s]", name, s.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Package returns the settings for the named package, creating them
+// if needed.
+func (c *Config) Package(name string) *PackageConfig {
+	p, ok := c.Packages[name]
+	if !ok {
+		p = &PackageConfig{}
+		c.Packages[name] = p
+	}
+	return p
+}
+
+// PackageRoot returns the directory packages are fetched and made
+// in.  That is BuildRoot if it is set and CacheDir/packages otherwise.
+func (c *Config) PackageRoot() string {
+	if c.BuildRoot != "" {
+		return c.BuildRoot
+	}
+	return path.Join(c.CacheDir, "packages")
+}
+
+// GitRepoURL returns where to clone the git repository for pkgbase
+// from.  That is under GitURL if it is set and under AurURL otherwise.
+func (c *Config) GitRepoURL(pkgbase string) string {
+	base := c.GitURL
+	if base == "" {
+		base = c.AurURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + pkgbase + ".git"
+}
+
+// SkipPgpCheckFor says whether pgp checks should be skipped for the
+// named package.
+func (c *Config) SkipPgpCheckFor(name string) bool {
+	if c.SkipPgpCheck {
+		return true
+	}
+	p, ok := c.Packages[name]
+	return ok && p.SkipPgpCheck
+}
+
+// LimitsFor returns the limits for making the named package.
+func (c *Config) LimitsFor(name string) Limits {
+	l := c.Limits
+	p, ok := c.Packages[name]
+	if !ok {
+		return l
+	}
+	if p.BuildTimeout != 0 {
+		l.BuildTimeout = p.BuildTimeout
+	}
+	if p.MemoryLimit != 0 {
+		l.MemoryLimit = p.MemoryLimit
+	}
+	if p.CPUs != 0 {
+		l.CPUs = p.CPUs
+	}
+	return l
+}
+
+func (c *Config) setOptions(s *Section) error {
+	for _, e := range s.Entries {
+		var err error
+		switch e.Key {
+		case "Fetchers":
+			c.Fetchers, err = parseInt(e)
+		case "Makers":
+			c.Makers, err = parseInt(e)
+		case "SkipPgpCheck":
+			c.SkipPgpCheck, err = parseBool(e)
+		case "NoConfirm":
+			c.NoConfirm, err = parseBool(e)
+		case "Quiet":
+			c.Quiet, err = parseBool(e)
+		case "NoReview":
+			c.NoReview, err = parseBool(e)
+		case "BuildRoot":
+			c.BuildRoot = e.Value
+		case "CacheDir":
+			c.CacheDir = e.Value
+		case "AurURL":
+			c.AurURL = e.Value
+		case "Git":
+			c.Git, err = parseBool(e)
+		case "Devel":
+			c.Devel, err = parseBool(e)
+		case "GitURL":
+			c.GitURL = e.Value
+		case "Sandbox":
+			c.Sandbox, err = parseBool(e)
+		case "SandboxOffline":
+			c.SandboxOffline, err = parseBool(e)
+		case "Chroot":
+			c.Chroot, err = parseBool(e)
+		case "ChrootTarball":
+			c.ChrootTarball = e.Value
+		case "DBPath":
+			c.DBPath = e.Value
+		case "PacmanConf":
+			c.PacmanConf = e.Value
+		case "RepoDir":
+			c.RepoDir = e.Value
+		case "RepoName":
+			c.RepoName = e.Value
+		case "IgnorePkg":
+			c.IgnorePkg = append(c.IgnorePkg, strings.Fields(e.Value)...)
+		case "IgnoreGroup":
+			c.IgnoreGroup = append(c.IgnoreGroup, strings.Fields(e.Value)...)
+		case "TotalTimeout":
+			c.TotalTimeout, err = parseDuration(e)
+		default:
+			err = c.Limits.set(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PackageConfig) set(s *Section) error {
+	for _, e := range s.Entries {
+		var err error
+		switch e.Key {
+		case "SkipPgpCheck":
+			p.SkipPgpCheck, err = parseBool(e)
+		default:
+			err = p.Limits.set(e)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set sets the limit e is for, or fails if e isn't a limit.
+func (l *Limits) set(e Entry) error {
+	var err error
+	switch e.Key {
+	case "BuildTimeout":
+		l.BuildTimeout, err = parseDuration(e)
+	case "MemoryLimit":
+		l.MemoryLimit, err = parseSize(e)
+	case "CPUs":
+		l.CPUs, err = strconv.ParseFloat(e.Value, 64)
+		if err != nil || l.CPUs < 0 {
+			err = errors.Errorf("%s:%d: %s must be a number, not %q", e.File, e.Line, e.Key, e.Value)
+		}
+	default:
+		err = unknownKey(e)
+	}
+	return err
+}
+
+func (l *Limits) write(add func(format string, v ...interface{})) {
+	add("BuildTimeout = %s", l.BuildTimeout)
+	add("MemoryLimit = %s", formatSize(l.MemoryLimit))
+	add("CPUs = %s", strconv.FormatFloat(l.CPUs, 'g', -1, 64))
+}
+
+// Write writes c in config file format.
+func (c *Config) Write(w io.Writer) error {
+	var lines []string
+	add := func(format string, v ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, v...))
+	}
+	add("[options]")
+	add("Fetchers = %d", c.Fetchers)
+	add("Makers = %d", c.Makers)
+	add("SkipPgpCheck = %t", c.SkipPgpCheck)
+	add("NoConfirm = %t", c.NoConfirm)
+	add("Quiet = %t", c.Quiet)
+	add("NoReview = %t", c.NoReview)
+	add("BuildRoot = %s", c.BuildRoot)
+	add("CacheDir = %s", c.CacheDir)
+	add("AurURL = %s", c.AurURL)
+	add("Git = %t", c.Git)
+	add("Devel = %t", c.Devel)
+	add("GitURL = %s", c.GitURL)
+	add("Sandbox = %t", c.Sandbox)
+	add("SandboxOffline = %t", c.SandboxOffline)
+	add("Chroot = %t", c.Chroot)
+	add("ChrootTarball = %s", c.ChrootTarball)
+	add("DBPath = %s", c.DBPath)
+	add("PacmanConf = %s", c.PacmanConf)
+	add("RepoDir = %s", c.RepoDir)
+	add("RepoName = %s", c.RepoName)
+	add("IgnorePkg = %s", strings.Join(c.IgnorePkg, " "))
+	add("IgnoreGroup = %s", strings.Join(c.IgnoreGroup, " "))
+	add("TotalTimeout = %s", c.TotalTimeout)
+	c.Limits.write(add)
+
+	names := make([]string, 0, len(c.Packages))
+	for n := range c.Packages {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		p := c.Packages[n]
+		add("")
+		add("[%s%s]", pkgSectionPrefix, n)
+		add("SkipPgpCheck = %t", p.SkipPgpCheck)
+		p.Limits.write(add)
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func parseInt(e Entry) (int, error) {
+	i, err := strconv.Atoi(e.Value)
+	if err != nil {
+		return 0, errors.Errorf("%s:%d: %s must be a number, not %q", e.File, e.Line, e.Key, e.Value)
+	}
+	return i, nil
+}
+
+func parseDuration(e Entry) (time.Duration, error) {
+	d, err := time.ParseDuration(e.Value)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("%s:%d: %s must be a duration such as 90m, not %q", e.File, e.Line, e.Key, e.Value)
+	}
+	return d, nil
+}
+
+// Size suffixes, in the order formatSize tries them.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseSize parses a number of bytes, which may end in K, M, G or T
+// for powers of 1024.
+func parseSize(e Entry) (int64, error) {
+	v := strings.TrimSpace(e.Value)
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(v), u.suffix) {
+			v = v[:len(v)-len(u.suffix)]
+			multiplier = u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("%s:%d: %s must be a size such as 4G, not %q", e.File, e.Line, e.Key, e.Value)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats n bytes so that parseSize can read it.
+func formatSize(n int64) string {
+	for _, u := range sizeUnits {
+		if n != 0 && n%u.bytes == 0 {
+			return strconv.FormatInt(n/u.bytes, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// A bare key means true.
+func parseBool(e Entry) (bool, error) {
+	if e.Value == "" {
+		return true, nil
+	}
+	b, err := strconv.ParseBool(e.Value)
+	if err != nil {
+		return false, errors.Errorf("%s:%d: %s must be true or false, not %q", e.File, e.Line, e.Key, e.Value)
+	}
+	return b, nil
+}
+
+func unknownKey(e Entry) error {
+	return errors.Errorf("%s:%d: unknown setting %q", e.File, e.Line, e.Key)
+}
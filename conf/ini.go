@@ -0,0 +1,149 @@
+// Package conf reads pacman.conf and the poltroon config file, which
+// share the same ini-like format.
+package conf
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Entry is a single setting.  Entries with no '=' have an empty Value.
+type Entry struct {
+	Key   string
+	Value string
+	// File and Line say where the entry came from.
+	File string
+	Line int
+}
+
+// Section holds the entries following a [Name] line, in order.
+type Section struct {
+	Name    string
+	Entries []Entry
+}
+
+// Values returns every value for key in s, in order, splitting each
+// on whitespace.  Keys are matched case-sensitively, as pacman does.
+func (s *Section) Values(key string) []string {
+	var result []string
+	for _, e := range s.Entries {
+		if e.Key == key {
+			result = append(result, strings.Fields(e.Value)...)
+		}
+	}
+	return result
+}
+
+// Last returns the last value for key in s, and whether there was one.
+func (s *Section) Last(key string) (Entry, bool) {
+	for i := len(s.Entries) - 1; i >= 0; i-- {
+		if s.Entries[i].Key == key {
+			return s.Entries[i], true
+		}
+	}
+	return Entry{}, false
+}
+
+// File is a parsed ini file.
+type File struct {
+	Sections []*Section
+}
+
+// Section returns the named section, or nil.  If a section appears
+// more than once, the entries are merged.
+func (f *File) Section(name string) *Section {
+	for _, s := range f.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// ParseFile reads an ini file.  Include lines are followed, with
+// globs expanded, and their entries added to the section containing
+// the Include, as pacman does.
+func ParseFile(name string) (*File, error) {
+	f := &File{}
+	if err := f.parse(name, nil, 0); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Guards against files that include each other.
+const maxIncludeDepth = 10
+
+func (f *File) parse(name string, current *Section, depth int) error {
+	if depth > maxIncludeDepth {
+		return errors.Errorf("%s: includes nested too deeply", name)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || len(line) < 3 {
+				return errors.Errorf("%s:%d: bad section header %q", name, lineNum, line)
+			}
+			current = f.addSection(line[1 : len(line)-1])
+			continue
+		}
+		if current == nil {
+			return errors.Errorf("%s:%d: %q is not in a section", name, lineNum, line)
+		}
+		key, value := line, ""
+		if i := strings.Index(line, "="); i != -1 {
+			key = strings.TrimSpace(line[:i])
+			value = strings.TrimSpace(line[i+1:])
+		}
+		if key == "Include" {
+			if err := f.include(value, current, depth); err != nil {
+				return errors.Wrapf(err, "%s:%d", name, lineNum)
+			}
+			continue
+		}
+		current.Entries = append(current.Entries, Entry{key, value, name, lineNum})
+	}
+	return scanner.Err()
+}
+
+func (f *File) include(pattern string, current *Section, depth int) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "Include %s", pattern)
+	}
+	for _, m := range matches {
+		if err := f.parse(m, current, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *File) addSection(name string) *Section {
+	if s := f.Section(name); s != nil {
+		return s
+	}
+	s := &Section{Name: name}
+	f.Sections = append(f.Sections, s)
+	return s
+}
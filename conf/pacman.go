@@ -0,0 +1,28 @@
+package conf
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DefaultPacmanConf is where pacman reads its configuration from.
+const DefaultPacmanConf = "/etc/pacman.conf"
+
+// PacmanConf holds the parts of pacman.conf we care about.
+type PacmanConf struct {
+	IgnorePkg   []string
+	IgnoreGroup []string
+}
+
+// ReadPacmanConf reads the [options] section of a pacman.conf.
+func ReadPacmanConf(name string) (*PacmanConf, error) {
+	f, err := ParseFile(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", name)
+	}
+	result := &PacmanConf{}
+	if options := f.Section("options"); options != nil {
+		result.IgnorePkg = options.Values("IgnorePkg")
+		result.IgnoreGroup = options.Values("IgnoreGroup")
+	}
+	return result, nil
+}
@@ -0,0 +1,42 @@
+package exec
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/ginabythebay/poltroon"
+)
+
+// PackageQuerier answers questions about installed packages and the
+// sync repositories.
+type PackageQuerier interface {
+	// Satisfied reports which of deps are satisfied by installed
+	// packages or could be installed from a sync repository.
+	Satisfied(deps []string) (map[string]bool, error)
+}
+
+// Builder makes and installs packages.
+type Builder interface {
+	// Make makes a fetched package.  If it is successful, a.PkgPaths
+	// is set to the packages made.  Cancelling ctx stops the make.
+	// Going over limits stops it too, with a *LimitError.
+	Make(ctx context.Context, a *poltroon.AurPackage, skippgpcheck bool, limits Limits) error
+	// Install installs the packages made for a.
+	Install(a *poltroon.AurPackage) error
+	// RefreshSudo updates the user's cached sudo credentials, prompting
+	// only if interactive is true.
+	RefreshSudo(interactive bool) error
+	// UpstreamCommand returns a command that runs name with args to
+	// look at a package's upstream sources, as isolated as makepkg
+	// would be when it fetches them.
+	UpstreamCommand(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// Backend is everything needed to update packages.  *Exec, which runs
+// pacman and makepkg, and *Fake implement it.
+type Backend interface {
+	PackageQuerier
+	Builder
+}
+
+var _ Backend = (*Exec)(nil)
@@ -0,0 +1,484 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/srcinfo"
+	"github.com/pkg/errors"
+)
+
+// RootMaker fills an empty directory with a root that makepkg can run
+// in, with pacman configured to install from the sync repositories.
+type RootMaker interface {
+	MakeRoot(ctx context.Context, dir string, log io.Writer) error
+}
+
+// Tarball is a RootMaker that extracts a prebuilt root, such as the
+// Arch Linux bootstrap tarball.
+type Tarball struct {
+	Path string
+	// Strip is how many leading path components to remove from each
+	// entry, e.g. 1 for the bootstrap tarball's root.x86_64
+	// directory.
+	Strip int
+}
+
+// MakeRoot extracts t into dir.  We leave this to tar, since a root
+// is well past the size we are willing to extract ourselves, and is
+// full of absolute symlinks.
+func (t *Tarball) MakeRoot(ctx context.Context, dir string, log io.Writer) error {
+	args := []string{"--extract", "--preserve-permissions", "--file", t.Path, "--directory", dir}
+	if t.Strip != 0 {
+		args = append(args, "--strip-components", strconv.Itoa(t.Strip))
+	}
+	cmd := exec.CommandContext(ctx, "tar", args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return errors.Wrapf(cmd.Run(), "extracting %s", t.Path)
+}
+
+// Pacstrap is a RootMaker that installs a root with the system's
+// pacman, the way pacstrap and mkarchroot do, but without needing to
+// be root.
+type Pacstrap struct {
+	// PacmanConf and MakepkgConf are copied into the root.  They
+	// default to the system's.
+	PacmanConf  string
+	MakepkgConf string
+	// Packages to install.  Defaults to base-devel.
+	Packages []string
+}
+
+// MakeRoot installs p's packages into dir.
+func (p *Pacstrap) MakeRoot(ctx context.Context, dir string, log io.Writer) error {
+	pacmanPath, err := findPgm("pacman")
+	if err != nil {
+		return err
+	}
+	sandbox, err := NewSandbox(false)
+	if err != nil {
+		return err
+	}
+	pacmanConf := p.PacmanConf
+	if pacmanConf == "" {
+		pacmanConf = "/etc/pacman.conf"
+	}
+	makepkgConf := p.MakepkgConf
+	if makepkgConf == "" {
+		makepkgConf = "/etc/makepkg.conf"
+	}
+	packages := p.Packages
+	if len(packages) == 0 {
+		packages = []string{"base-devel"}
+	}
+
+	for _, d := range []string{"etc/pacman.d", "var/lib/pacman", "var/cache/pacman/pkg", "var/log", "dev", "proc", "sys"} {
+		if err = os.MkdirAll(path.Join(dir, d), 0755); err != nil {
+			return errors.Wrap(err, "making root")
+		}
+	}
+	if err = writeChrootPacmanConf(pacmanConf, path.Join(dir, "etc/pacman.conf")); err != nil {
+		return err
+	}
+	for _, c := range []struct{ from, to string }{
+		{makepkgConf, "etc/makepkg.conf"},
+		{"/etc/pacman.d/mirrorlist", "etc/pacman.d/mirrorlist"},
+	} {
+		if err = copyFile(c.from, path.Join(dir, c.to)); err != nil {
+			return err
+		}
+	}
+
+	// We are root only in the sandbox, so pacman can install files
+	// owned by anyone, and the install scriptlets it runs chrooted in
+	// dir find what they expect there.
+	spec := &sandboxSpec{
+		AsRoot: true,
+		Binds: []bindMount{
+			{Source: dir, Dest: dir},
+			{Source: "/dev", Dest: path.Join(dir, "dev")},
+			{Source: "/proc", Dest: path.Join(dir, "proc")},
+			{Source: "/sys", Dest: path.Join(dir, "sys"), ReadOnly: true},
+		},
+		Dir:  dir,
+		Path: pacmanPath,
+		Args: append([]string{pacmanPath,
+			"--root", dir,
+			"--dbpath", path.Join(dir, "var/lib/pacman"),
+			"--cachedir", path.Join(dir, "var/cache/pacman/pkg"),
+			"--logfile", path.Join(dir, "var/log/pacman.log"),
+			"--config", path.Join(dir, "etc/pacman.conf"),
+			"--noconfirm", "--sync", "--refresh"}, packages...),
+	}
+	cmd := sandbox.specCommand(ctx, spec, true, os.Environ())
+	cmd.Stdout = log
+	cmd.Stderr = log
+	return errors.Wrap(cmd.Run(), "installing root")
+}
+
+// writeChrootPacmanConf copies the pacman.conf at from to to.  pacman
+// can't switch to another user to download in a root we made, so we
+// ask it not to.  Versions of pacman that don't do that anyway only
+// warn about the directive.
+func writeChrootPacmanConf(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", from)
+	}
+	defer in.Close()
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		out.WriteString(scanner.Text())
+		out.WriteByte('\n')
+		if strings.TrimSpace(scanner.Text()) == "[options]" {
+			out.WriteString("DisableSandbox\n")
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.Wrapf(err, "reading %s", from)
+	}
+	return errors.Wrapf(ioutil.WriteFile(to, out.Bytes(), 0644), "writing %s", to)
+}
+
+// Chroot is a Builder that makes each package in a fresh copy of a
+// clean root, which only has what the package says it needs.  Other
+// AUR packages it needs must have been made and installed by us
+// first.
+//
+// Everything runs in a Sandbox, so nothing needs to be root, but
+// makepkg won't run if we are.
+type Chroot struct {
+	// Dir holds the clean root, and the copies of it that packages
+	// are made in.
+	Dir   string
+	Maker RootMaker
+
+	sandbox *Sandbox
+
+	rootMu  sync.Mutex
+	updated bool
+
+	mu sync.Mutex
+	// By package name.  Whatever we installed, so that packages that
+	// depend on them can have them installed too.
+	built map[string]*poltroon.AurPackage
+}
+
+var _ Builder = (*Chroot)(nil)
+
+// NewChroot returns a Chroot that keeps its roots under dir, making
+// the clean one with maker.
+func NewChroot(dir string, maker RootMaker) (*Chroot, error) {
+	sandbox, err := NewSandbox(false)
+	if err != nil {
+		return nil, errors.Wrap(err, "chroot builds")
+	}
+	return &Chroot{
+		Dir:     dir,
+		Maker:   maker,
+		sandbox: sandbox,
+		built:   map[string]*poltroon.AurPackage{},
+	}, nil
+}
+
+// Where pacman and makepkg are, in the root.
+const (
+	chrootPacman  = "/usr/bin/pacman"
+	chrootMakepkg = "/usr/bin/makepkg"
+)
+
+// Where a's directories are, in the root.
+const (
+	chrootBuild   = "/build"
+	chrootPkgdest = "/pkgdest"
+	chrootSrcdest = "/srcdest"
+	chrootDeps    = "/var/cache/poltroon"
+)
+
+// Make makes a in a copy of the clean root, installing what the
+// PKGBUILD needs there first.  Only makepkg runs under limits.
+func (c *Chroot) Make(ctx context.Context, a *poltroon.AurPackage, skippgpcheck bool, limits Limits) error {
+	stdout, stderr, err := openLogs(a)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+	lim := newLimiter(limits, a.Base(), stderr)
+	defer lim.close()
+
+	if err = lim.check(c.make(ctx, a, lim, skippgpcheck, stdout, stderr)); err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "making %s in chroot.  See %s", a.Name, a.Logs())
+		}
+		return errors.Wrapf(err, "making %s in chroot.  See %s", a.Name, a.Logs())
+	}
+	return nil
+}
+
+func (c *Chroot) make(ctx context.Context, a *poltroon.AurPackage, lim *limiter, skippgpcheck bool, stdout, stderr io.Writer) error {
+	clean, err := c.cleanRoot(ctx, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	root := path.Join(c.Dir, "builds", a.Base())
+	if err = removeTree(root); err != nil {
+		return errors.Wrap(err, "removing old root")
+	}
+	if err = os.MkdirAll(path.Dir(root), 0755); err != nil {
+		return err
+	}
+	cp := exec.CommandContext(ctx, "cp", "--archive", "--reflink=auto", clean, root)
+	cp.Stderr = stderr
+	if err = cp.Run(); err != nil {
+		return errors.Wrap(err, "copying clean root")
+	}
+	defer removeTree(root)
+
+	// Trim to the resolution of the file system, as Exec.Make does.
+	start := time.Now().Truncate(time.Second)
+
+	if deps := c.aurDepends(a); len(deps) != 0 {
+		if err = os.MkdirAll(path.Join(root, chrootDeps), 0755); err != nil {
+			return err
+		}
+		args := []string{"--upgrade", "--noconfirm", "--asdeps"}
+		for _, d := range deps {
+			dest := path.Join(chrootDeps, path.Base(d))
+			if err = copyFile(d, path.Join(root, dest)); err != nil {
+				return err
+			}
+			args = append(args, dest)
+		}
+		if err = c.run(ctx, a, root, nil, true, false, stdout, stderr, chrootPacman, args...); err != nil {
+			return errors.Wrap(err, "installing AUR dependencies")
+		}
+	}
+
+	var info bytes.Buffer
+	if err = c.run(ctx, a, root, lim, false, false, &info, stderr, chrootMakepkg, "--printsrcinfo"); err != nil {
+		return errors.Wrap(err, "makepkg --printsrcinfo")
+	}
+	s, err := srcinfo.Parse(&info)
+	if err != nil {
+		return err
+	}
+	if deps := s.MakeDepends(srcinfo.HostArch()); len(deps) != 0 {
+		var missing bytes.Buffer
+		err = c.run(ctx, a, root, nil, true, false, &missing, stderr, chrootPacman, append([]string{"--deptest"}, deps...)...)
+		// pacman exits with 127 when some dependencies are not satisfied
+		if status, ok := exitStatus(err); !ok || (status != 0 && status != 127) {
+			return errors.Wrap(err, "executing pacman --deptest")
+		}
+		if needed := strings.Fields(missing.String()); len(needed) != 0 {
+			args := append([]string{"--sync", "--needed", "--asdeps", "--noconfirm"}, needed...)
+			if err = c.run(ctx, a, root, nil, true, true, stdout, stderr, chrootPacman, args...); err != nil {
+				return errors.Wrapf(err, "installing %s", strings.Join(needed, ", "))
+			}
+		}
+	}
+
+	args := []string{"--nodeps", "--force"}
+	if skippgpcheck {
+		args = append(args, "--skippgpcheck")
+	}
+	if err = c.run(ctx, a, root, lim, false, true, stdout, stderr, chrootMakepkg, args...); err != nil {
+		return err
+	}
+	return madeSince(a, start)
+}
+
+// cleanRoot returns the clean root, making it first if there isn't
+// one yet.  The first time through, it brings the root up to date
+// with the sync repositories.
+func (c *Chroot) cleanRoot(ctx context.Context, stdout, stderr io.Writer) (string, error) {
+	c.rootMu.Lock()
+	defer c.rootMu.Unlock()
+
+	root := path.Join(c.Dir, "root")
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		// Made to the side, so that a root we failed to finish
+		// never gets used.
+		partial := root + ".partial"
+		if err = removeTree(partial); err != nil {
+			return "", err
+		}
+		if err = os.MkdirAll(partial, 0755); err != nil {
+			return "", errors.Wrap(err, "making clean root")
+		}
+		if err = c.Maker.MakeRoot(ctx, partial, stdout); err != nil {
+			return "", errors.Wrap(err, "making clean root")
+		}
+		if err = os.Rename(partial, root); err != nil {
+			return "", errors.Wrap(err, "making clean root")
+		}
+		c.updated = true
+	} else if err != nil {
+		return "", err
+	}
+
+	if !c.updated {
+		spec := c.spec(root, true, chrootPacman, "--sync", "--refresh", "--sysupgrade", "--noconfirm")
+		cmd := c.command(ctx, spec, true, "")
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return "", errors.Wrap(err, "updating clean root")
+		}
+		c.updated = true
+	}
+	return root, nil
+}
+
+// aurDepends returns the packages we made that a depends on, and the
+// ones they depend on in turn.
+func (c *Chroot) aurDepends(a *poltroon.AurPackage) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var paths []string
+	seen := map[string]bool{}
+	var visit func(names []string)
+	visit = func(names []string) {
+		for _, n := range names {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			dep, ok := c.built[n]
+			if !ok {
+				continue
+			}
+			paths = append(paths, dep.PkgPaths...)
+			visit(dep.AurDepends)
+		}
+	}
+	visit(a.AurDepends)
+	return paths
+}
+
+// run runs name with args in root, with a's build, package and source
+// directories mounted where the root's makepkg will use them.  It
+// runs under lim, if that isn't nil.
+func (c *Chroot) run(ctx context.Context, a *poltroon.AurPackage, root string, lim *limiter, asRoot, network bool, stdout, stderr io.Writer, name string, args ...string) error {
+	spec := c.spec(root, asRoot, name, args...)
+	spec.Binds = append(spec.Binds,
+		bindMount{Source: a.Build(), Dest: chrootBuild},
+		bindMount{Source: a.Packages(), Dest: chrootPkgdest},
+		bindMount{Source: a.Sources(), Dest: chrootSrcdest})
+	spec.Dir = path.Join(chrootBuild, a.Base())
+	cmd := c.command(ctx, spec, network, chrootBuild)
+	cmd.Env = append(cmd.Env, "PKGDEST="+chrootPkgdest, "SRCDEST="+chrootSrcdest, "BUILDDIR="+chrootBuild)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := lim.apply(cmd); err != nil {
+		return err
+	}
+	return cmd.Run()
+}
+
+func (c *Chroot) spec(root string, asRoot bool, name string, args ...string) *sandboxSpec {
+	spec := &sandboxSpec{
+		Root:   root,
+		AsRoot: asRoot,
+		Empty:  []emptyDir{{Path: "/dev/shm", Mode: 01777}},
+		Dir:    "/",
+		Path:   name,
+		Args:   append([]string{name}, args...),
+	}
+	// So that names can be looked up when the network is there.
+	if _, err := os.Stat("/etc/resolv.conf"); err == nil {
+		spec.Binds = append(spec.Binds, bindMount{Source: "/etc/resolv.conf", Dest: "/etc/resolv.conf", ReadOnly: true})
+	}
+	return spec
+}
+
+// command returns a command that does what spec says, with an
+// environment of its own rather than ours, which would refer to
+// things the root doesn't have.
+func (c *Chroot) command(ctx context.Context, spec *sandboxSpec, network bool, home string) *exec.Cmd {
+	if home == "" {
+		home = "/root"
+	}
+	env := []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/bin", "HOME=" + home}
+	for _, k := range []string{"LANG", "TERM", "SOURCE_DATE_EPOCH"} {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	cmd := c.sandbox.specCommand(ctx, spec, network, env)
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd
+}
+
+// UpstreamCommand runs name in c's sandbox.  It uses the system's
+// programs, since the clean root might not have them.
+func (c *Chroot) UpstreamCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return c.sandbox.upstreamCommand(ctx, name, args...)
+}
+
+// RefreshSudo does nothing, since we never need sudo.
+func (c *Chroot) RefreshSudo(interactive bool) error {
+	return nil
+}
+
+// Install doesn't touch the system.  It remembers a, so that it can be
+// installed in the roots of packages that depend on it.
+func (c *Chroot) Install(a *poltroon.AurPackage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.built[a.Name] = a
+	return nil
+}
+
+// copyFile copies the regular file at from to to.
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return errors.Wrapf(err, "copying %s", from)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "copying %s", from)
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "copying %s", from)
+	}
+	return errors.Wrapf(out.Close(), "copying %s", from)
+}
+
+// removeTree removes dir and everything in it.  A root has read-only
+// directories in it that os.RemoveAll can't empty on its own, even
+// though we own them.
+func removeTree(dir string) error {
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(p, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
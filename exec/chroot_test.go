@@ -0,0 +1,194 @@
+package exec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ginabythebay/poltroon"
+)
+
+// Stand-ins for pacman and makepkg, installed in the test root.
+// Packages count as installed when /var/lib/fake has a file named for
+// them.
+const (
+	pacmanStub = `#!/usr/bin/bash
+echo "$EUID $*" >> /build/pacman.log
+case "$1" in
+--deptest)
+	shift
+	status=0
+	for d in "$@"; do
+		if ! [ -e "/var/lib/fake/$d" ]; then
+			echo "$d"
+			status=127
+		fi
+	done
+	exit $status
+	;;
+--sync)
+	for p in "$@"; do
+		case "$p" in
+		--*) ;;
+		*) : > "/var/lib/fake/$p" ;;
+		esac
+	done
+	;;
+--upgrade)
+	for p in "$@"; do
+		case "$p" in
+		--*) ;;
+		*) f="${p##*/}"; : > "/var/lib/fake/${f%-*-*-*}" ;;
+		esac
+	done
+	;;
+esac
+`
+	makepkgStub = `#!/usr/bin/bash
+if [ "$1" = --printsrcinfo ]; then
+	cat .SRCINFO
+	exit
+fi
+echo "$EUID $PWD $*" >> /build/makepkg.log
+echo /var/lib/fake/* >> /build/makepkg.log
+[ -e "$SECRET" ] || echo hidden >> /build/makepkg.log
+while read k _ v; do
+	[ "$k" = pkgname ] && name=$v
+done < .SRCINFO
+echo "pkgname = $name" > .PKGINFO
+tar -cf "$PKGDEST/$name-1-1-x86_64.pkg.tar" .PKGINFO
+`
+)
+
+// countingMaker counts the roots it makes.
+type countingMaker struct {
+	RootMaker
+	made int
+}
+
+func (m *countingMaker) MakeRoot(ctx context.Context, dir string, log io.Writer) error {
+	m.made++
+	return m.RootMaker.MakeRoot(ctx, dir, log)
+}
+
+// makeTestRoot makes a tarball of a root holding the stubs and just
+// enough of the system to run them.
+func makeTestRoot(t *testing.T, dir string) string {
+	rootfs := path.Join(dir, "rootfs")
+	for _, d := range []string{"usr/bin", "var/lib/fake", "etc"} {
+		ok(t, os.MkdirAll(path.Join(rootfs, d), 0755))
+	}
+	for _, pgm := range []string{"bash", "cat", "tar"} {
+		p, err := exec.LookPath(pgm)
+		if err != nil {
+			t.Skipf("no %s to put in the root", pgm)
+		}
+		files := []string{p}
+		out, err := exec.Command("ldd", p).Output()
+		if err != nil {
+			t.Skipf("unable to find libraries for %s: %v", pgm, err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			for _, f := range strings.Fields(scanner.Text()) {
+				if path.IsAbs(f) {
+					files = append(files, f)
+				}
+			}
+		}
+		for _, f := range files {
+			dest := path.Join(rootfs, f)
+			if f == p {
+				dest = path.Join(rootfs, "usr/bin", pgm)
+			}
+			ok(t, os.MkdirAll(path.Dir(dest), 0755))
+			ok(t, copyFile(f, dest))
+			ok(t, os.Chmod(dest, 0755))
+		}
+	}
+	ok(t, ioutil.WriteFile(path.Join(rootfs, "usr/bin/pacman"), []byte(pacmanStub), 0755))
+	ok(t, ioutil.WriteFile(path.Join(rootfs, "usr/bin/makepkg"), []byte(makepkgStub), 0755))
+	ok(t, ioutil.WriteFile(path.Join(rootfs, "var/lib/fake/bash"), nil, 0644))
+
+	tarball := path.Join(dir, "root.tar")
+	out, err := exec.Command("tar", "--create", "--file", tarball, "--directory", rootfs, ".").CombinedOutput()
+	assert(t, err == nil, "tar: %v\n%s", err, out)
+	return tarball
+}
+
+func chrootPackage(t *testing.T, root, name, depends, makedepends string) *poltroon.AurPackage {
+	a := poltroon.NewAurPackage(root, name, "", "1-1", "")
+	ok(t, a.PreparePackageDir(0755))
+	dir := path.Join(a.Build(), a.Base())
+	ok(t, os.MkdirAll(dir, 0755))
+	info := fmt.Sprintf("pkgbase = %s\n\tpkgver = 1\n\tpkgrel = 1\n\tarch = any\n\tmakedepends = %s\n\tdepends = %s\n\npkgname = %s\n", name, makedepends, depends, name)
+	ok(t, ioutil.WriteFile(path.Join(dir, ".SRCINFO"), []byte(info), 0644))
+	return a
+}
+
+func readLog(t *testing.T, a *poltroon.AurPackage, name string) string {
+	b, err := ioutil.ReadFile(path.Join(a.Build(), name))
+	ok(t, err)
+	return string(b)
+}
+
+func TestChrootMake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_chroot_test")
+	ok(t, err)
+	defer removeTree(dir)
+
+	secret := path.Join(dir, "secret")
+	ok(t, ioutil.WriteFile(secret, nil, 0600))
+	oldSecret, hadSecret := os.LookupEnv("SECRET")
+	os.Setenv("SECRET", secret)
+	defer func() {
+		if hadSecret {
+			os.Setenv("SECRET", oldSecret)
+		} else {
+			os.Unsetenv("SECRET")
+		}
+	}()
+
+	maker := &countingMaker{RootMaker: &Tarball{Path: makeTestRoot(t, dir)}}
+	c, err := NewChroot(path.Join(dir, "chroot"), maker)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	lib := chrootPackage(t, dir, "lib", "bash", "cmake")
+	app := chrootPackage(t, dir, "app", "lib", "meson")
+	app.AurDepends = []string{"lib"}
+
+	if err = c.Make(context.Background(), lib, false, Limits{}); err != nil {
+		logged, _ := ioutil.ReadFile(path.Join(lib.Logs(), "make.err"))
+		if strings.Contains(string(logged), "poltroon sandbox:") {
+			t.Skipf("unable to make namespaces here: %s", logged)
+		}
+		ok(t, err)
+	}
+	equals(t, []string{path.Join(lib.Packages(), "lib-1-1-x86_64.pkg.tar")}, lib.PkgPaths)
+	ok(t, c.Install(lib))
+	ok(t, c.Make(context.Background(), app, false, Limits{}))
+	equals(t, []string{path.Join(app.Packages(), "app-1-1-x86_64.pkg.tar")}, app.PkgPaths)
+
+	uid := os.Getuid()
+	equals(t, "0 --deptest bash cmake\n0 --sync --needed --asdeps --noconfirm cmake\n", readLog(t, lib, "pacman.log"))
+	equals(t, fmt.Sprintf("%d /build/lib --nodeps --force\n/var/lib/fake/bash /var/lib/fake/cmake\nhidden\n", uid), readLog(t, lib, "makepkg.log"))
+
+	// app gets lib, but not what lib's root had installed.
+	equals(t, "0 --upgrade --noconfirm --asdeps /var/cache/poltroon/lib-1-1-x86_64.pkg.tar\n0 --deptest lib meson\n0 --sync --needed --asdeps --noconfirm meson\n", readLog(t, app, "pacman.log"))
+	equals(t, fmt.Sprintf("%d /build/app --nodeps --force\n/var/lib/fake/bash /var/lib/fake/lib /var/lib/fake/meson\nhidden\n", uid), readLog(t, app, "makepkg.log"))
+
+	equals(t, 1, maker.made)
+	builds, err := ioutil.ReadDir(path.Join(dir, "chroot", "builds"))
+	ok(t, err)
+	equals(t, 0, len(builds))
+}
@@ -2,18 +2,28 @@ package exec
 
 import (
 	"bufio"
-	"fmt"
+	"bytes"
+	"context"
+	"io"
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/srcinfo"
 	"github.com/pkg/errors"
 )
 
 type Exec struct {
+	// Sandbox, if set, isolates makepkg from the rest of the system.
+	Sandbox *Sandbox
+	// SyncOnly makes Satisfied ignore what is installed, for builds
+	// that only get what the sync repositories have.
+	SyncOnly bool
+
 	pacmanPath  string
 	makePkgPath string
 }
@@ -44,82 +54,278 @@ func Find() (*Exec, error) {
 		return nil, err
 	}
 
-	return &Exec{pacmanPath, makePkgPath}, nil
+	return &Exec{pacmanPath: pacmanPath, makePkgPath: makePkgPath}, nil
 }
 
-// QueryForeignPackages returns all packages that are installed but
-// don't exist in the sync databases (e.g. they were installed via
-// pacman --upgrade)
-func (e *Exec) QueryForeignPackages() ([]VersionedPackage, error) {
-	cmd := exec.Command(e.pacmanPath, "--query", "--foreign")
-	cmd.Stderr = os.Stderr
-	stdout, err := cmd.StdoutPipe()
+// Satisfied reports which of deps are satisfied by installed
+// packages or could be installed from a sync repository.  Uses
+// pacman --deptest and then pacman --sync --print for whatever isn't
+// installed.  With SyncOnly, only the second step is used.
+func (e *Exec) Satisfied(deps []string) (map[string]bool, error) {
+	result := map[string]bool{}
+	if len(deps) == 0 {
+		return result, nil
+	}
+
+	unsatisfied := map[string]bool{}
+	if e.SyncOnly {
+		for _, d := range deps {
+			unsatisfied[d] = true
+		}
+	} else {
+		cmd := exec.Command(e.pacmanPath, append([]string{"--deptest"}, deps...)...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		// pacman exits with 127 when some dependencies are not satisfied
+		if status, ok := exitStatus(err); !ok || (status != 0 && status != 127) {
+			return nil, errors.Wrap(err, "executing pacman --deptest")
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			unsatisfied[strings.TrimSpace(scanner.Text())] = true
+		}
+	}
+
+	for _, d := range deps {
+		if !unsatisfied[d] {
+			result[d] = true
+			continue
+		}
+		// One at a time, because pacman fails the whole command if
+		// any target is missing.
+		cmd := exec.Command(e.pacmanPath, "--sync", "--print", "--print-format", "%n", d)
+		err := cmd.Run()
+		if _, ok := exitStatus(err); !ok {
+			return nil, errors.Wrapf(err, "executing pacman --sync --print for %s", d)
+		}
+		if err == nil {
+			result[d] = true
+		}
+	}
+	return result, nil
+}
+
+// Make runs makepkg on a fetched command.  If it is successful, a.PkgPaths will be set
+// to the packages we built.  Signatures, and anything left in the
+// packages directory from before, are left out.
+//
+// makepkg runs in its own process group, so that an interrupt from the
+// terminal doesn't reach it.  Cancelling ctx kills the whole group.
+// Because makepkg is then not in the foreground, sudo can't prompt for
+// a password; see RefreshSudo.
+func (e *Exec) Make(ctx context.Context, a *poltroon.AurPackage, skippgpcheck bool, limits Limits) error {
+	stdout, stderr, err := openLogs(a)
 	if err != nil {
-		return nil, errors.Wrap(err, "Getting stdout for pacman")
-	}
-	if err = cmd.Start(); err != nil {
-		return nil, errors.Wrap(err, "starting pacman")
-	}
-	pkgs := []VersionedPackage{}
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Example line:
-		// ledger 3.1.1-3
-		var name, version string
-		_, err = fmt.Sscan(line, &name, &version)
-		if err != nil {
-			return nil, errors.Wrapf(err, "Unable to parse [%s]", line)
+		return err
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+	lim := newLimiter(limits, a.Base(), stderr)
+	defer lim.close()
+
+	// File times may only be kept to the second.
+	start := time.Now().Truncate(time.Second)
+	if e.Sandbox != nil {
+		err = e.makeSandboxed(ctx, a, lim, skippgpcheck, stdout, stderr)
+	} else {
+		// --force, because we only get here if we want a new package,
+		// whatever an earlier run left behind.
+		args := []string{"--syncdeps", "--force", a.Name}
+		if skippgpcheck {
+			args = append(args, "--skippgpcheck")
 		}
-		pkgs = append(pkgs, VersionedPackage{name, version})
+		err = e.makepkg(ctx, a, lim, true, stdout, stderr, args...)
 	}
-	if err = cmd.Wait(); err != nil {
-		return nil, errors.Wrap(err, "executing pacman")
+	err = lim.check(err)
+	if err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrapf(ctx.Err(), "running makepkg for %s.  See %s", a.Name, a.Logs())
+		}
+		return errors.Wrapf(err, "running makepkg for %s.  See %s", a.Name, a.Logs())
 	}
-	return pkgs, nil
+	return madeSince(a, start)
 }
 
-// VersionedPackage is just a package name with a version.
-type VersionedPackage struct {
-	Name    string
-	Version string
+// openLogs creates the files that the output of making a goes to.
+func openLogs(a *poltroon.AurPackage) (stdout, stderr *os.File, err error) {
+	stdout, err = os.Create(path.Join(a.Logs(), "make.out"))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Making %s", a.Name)
+	}
+	stderr, err = os.Create(path.Join(a.Logs(), "make.err"))
+	if err != nil {
+		stdout.Close()
+		return nil, nil, errors.Wrapf(err, "Making %s", a.Name)
+	}
+	return stdout, stderr, nil
 }
 
-// Make runs makepkg on a fetched command.  If it is successful, a.PkgPaths will be set
-// to the package we built.
-func (e *Exec) Make(a *poltroon.AurPackage, skippgpcheck bool) error {
-	cmd := exec.Command(e.makePkgPath, "--syncdeps", a.Name)
-	if skippgpcheck {
-		cmd.Args = append(cmd.Args, "--skippgpcheck")
+// madeSince sets a.PkgPaths to the packages made since start, and
+// returns an error if there aren't any.
+func madeSince(a *poltroon.AurPackage, start time.Time) error {
+	all, err := a.PackageFiles()
+	if err != nil {
+		return errors.Wrapf(err, "globbing makepkg for %s.  See %s", a.Name, a.Packages())
 	}
-	cmd.Dir = path.Join(a.Build(), a.Name)
-	stdout, err := os.Create(path.Join(a.Logs(), "make.out"))
+	var matches []string
+	for _, m := range all {
+		info, err := os.Stat(m)
+		if err != nil {
+			return errors.Wrapf(err, "checking makepkg output for %s", a.Name)
+		}
+		if !info.ModTime().Before(start) {
+			matches = append(matches, m)
+		}
+	}
+	if len(matches) == 0 {
+		return errors.Errorf("makepkg made no packages for %s.  See %s", a.Name, a.Packages())
+	}
+
+	a.PkgPaths = matches
+	return nil
+}
+
+// makeSandboxed makes a in e.Sandbox.  makepkg can't install anything
+// from there, so we install what makepkg --printsrcinfo says the
+// PKGBUILD needs first.  When offline, sources are downloaded and
+// extracted by makepkg --nobuild, and then the packages are made with
+// the network cut off.
+func (e *Exec) makeSandboxed(ctx context.Context, a *poltroon.AurPackage, lim *limiter, skippgpcheck bool, stdout, stderr io.Writer) error {
+	var info bytes.Buffer
+	if err := e.makepkg(ctx, a, lim, false, &info, stderr, "--printsrcinfo"); err != nil {
+		return errors.Wrap(err, "makepkg --printsrcinfo")
+	}
+	s, err := srcinfo.Parse(&info)
 	if err != nil {
-		return errors.Wrapf(err, "Making %s", a.Name)
+		return err
 	}
-	defer stdout.Close()
+	if err = e.installDeps(ctx, s.MakeDepends(srcinfo.HostArch()), stdout, stderr); err != nil {
+		return err
+	}
+
+	args := []string{"--nodeps", "--force"}
+	if skippgpcheck {
+		args = append(args, "--skippgpcheck")
+	}
+	if !e.Sandbox.Offline {
+		return e.makepkg(ctx, a, lim, true, stdout, stderr, args...)
+	}
+	if err = e.makepkg(ctx, a, lim, true, stdout, stderr, append(args, "--nobuild")...); err != nil {
+		return errors.Wrap(err, "makepkg --nobuild")
+	}
+	return e.makepkg(ctx, a, lim, false, stdout, stderr, append(args, "--noextract")...)
+}
+
+// makepkg runs makepkg with args in a's build directory, in e.Sandbox
+// if there is one.  network says whether a sandboxed makepkg may use
+// the network.  It runs under lim.
+func (e *Exec) makepkg(ctx context.Context, a *poltroon.AurPackage, lim *limiter, network bool, stdout, stderr io.Writer, args ...string) error {
+	dir := path.Join(a.Build(), a.Base())
+	var cmd *exec.Cmd
+	if e.Sandbox != nil {
+		writable := []string{a.Build(), a.Packages(), a.Sources()}
+		cmd = e.Sandbox.command(ctx, dir, writable, network, e.makePkgPath, args...)
+		// Sources have to be extracted where the second makepkg
+		// will look for them, whatever makepkg.conf says.
+		cmd.Env = append(cmd.Env, "BUILDDIR="+a.Build())
+	} else {
+		cmd = exec.CommandContext(ctx, e.makePkgPath, args...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Env = os.Environ()
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Env, "PKGDEST="+a.Packages(), "SRCDEST="+a.Sources())
 	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := lim.apply(cmd); err != nil {
+		return err
+	}
+	return cmd.Run()
+}
 
-	stderr, err := os.Create(path.Join(a.Logs(), "make.err"))
-	if err != nil {
-		return errors.Wrapf(err, "Making %s", a.Name)
+// installDeps installs whichever of deps aren't installed from the
+// sync repositories, as makepkg --syncdeps would.
+func (e *Exec) installDeps(ctx context.Context, deps []string, stdout, stderr io.Writer) error {
+	if len(deps) == 0 {
+		return nil
 	}
-	defer stderr.Close()
+	cmd := exec.CommandContext(ctx, e.pacmanPath, append([]string{"--deptest"}, deps...)...)
 	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	// pacman exits with 127 when some dependencies are not satisfied
+	if status, ok := exitStatus(err); !ok || (status != 0 && status != 127) {
+		return errors.Wrap(err, "executing pacman --deptest")
+	}
+	missing := strings.Fields(string(out))
+	if len(missing) == 0 {
+		return nil
+	}
 
+	sudoPath, err := findPgm("sudo")
+	if err != nil {
+		return err
+	}
+	cmd = exec.CommandContext(ctx, sudoPath, e.pacmanPath, "--sync", "--needed", "--asdeps", "--noconfirm")
+	cmd.Args = append(cmd.Args, missing...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	if err = cmd.Run(); err != nil {
-		return errors.Wrapf(err, "running makepkg for %s.  See %s", a.Name, a.Logs())
+		return errors.Wrapf(err, "installing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// UpstreamCommand runs name in e.Sandbox, if there is one.
+func (e *Exec) UpstreamCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if e.Sandbox != nil {
+		return e.Sandbox.upstreamCommand(ctx, name, args...)
 	}
+	return exec.CommandContext(ctx, name, args...)
+}
 
-	matches, err := filepath.Glob(path.Join(cmd.Dir, "*.pkg.*"))
+// RefreshSudo updates the user's cached sudo credentials, so that
+// makepkg can install dependencies without prompting.  If interactive
+// is true, sudo may prompt for a password; otherwise it fails if one
+// is needed.
+func (e *Exec) RefreshSudo(interactive bool) error {
+	sudoPath, err := findPgm("sudo")
 	if err != nil {
-		return errors.Wrapf(err, "globbing makepkg for %s.  See %s", a.Name, cmd.Dir)
+		return err
 	}
-	if len(matches) == 0 {
-		return errors.Errorf("Expected at least one match but got this instead: %v", matches)
+	cmd := exec.Command(sudoPath, "--validate")
+	if !interactive {
+		cmd.Args = append(cmd.Args, "--non-interactive")
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return errors.Wrap(err, "refreshing sudo credentials")
 	}
+	return nil
+}
 
-	a.PkgPaths = matches
+// Install installs the packages made for a, so that other packages
+// depending on it can be made.  Uses sudo, just as makepkg --syncdeps
+// does.  Packages that were only pulled in as dependencies are
+// installed with --asdeps.
+func (e *Exec) Install(a *poltroon.AurPackage) error {
+	sudoPath, err := findPgm("sudo")
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(sudoPath, e.pacmanPath, "--upgrade", "--noconfirm")
+	if a.Dependency {
+		cmd.Args = append(cmd.Args, "--asdeps")
+	}
+	cmd.Args = append(cmd.Args, a.PkgPaths...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "installing %s: %s", a.Name, out)
+	}
 	return nil
 }
 
@@ -0,0 +1,174 @@
+package exec
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/pkg/errors"
+)
+
+// FakeResult scripts what happens when Fake makes a package.
+type FakeResult struct {
+	// Delay is how long the make takes.  Cancelling the context cuts
+	// it short.
+	Delay time.Duration
+	// Err, if set, is returned instead of making anything.
+	Err error
+	// Made lists the package names to make.  Defaults to everything
+	// wanted from the package.
+	Made []string
+	// Version is the version of the packages made.  Defaults to the
+	// package's NextVersion, or 1-1 if it has none.
+	Version string
+}
+
+// Fake is a Backend that doesn't run anything, for tests.  Makes
+// succeed unless Results says otherwise, and write real package files
+// holding just a .PKGINFO.  It is safe to use from several goroutines.
+type Fake struct {
+	// Available holds the dependencies Satisfied reports as
+	// satisfied.
+	Available map[string]bool
+	// Results holds what happens when each package is made, by name.
+	Results map[string]FakeResult
+	// InstallErrs holds errors to return from Install, by name.
+	InstallErrs map[string]error
+
+	mu        sync.Mutex // protects this group
+	made      []string
+	installed []string
+}
+
+var _ Backend = (*Fake)(nil)
+
+// Satisfied reports which of deps are in f.Available.
+func (f *Fake) Satisfied(deps []string) (map[string]bool, error) {
+	result := map[string]bool{}
+	for _, d := range deps {
+		if f.Available[d] {
+			result[d] = true
+		}
+	}
+	return result, nil
+}
+
+// Make pretends to make a, as scripted by f.Results.  limits are
+// ignored.
+func (f *Fake) Make(ctx context.Context, a *poltroon.AurPackage, skippgpcheck bool, limits Limits) error {
+	result := f.Results[a.Name]
+	if result.Delay != 0 {
+		t := time.NewTimer(result.Delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "faking make of %s", a.Name)
+		case <-t.C:
+		}
+	}
+	if result.Err != nil {
+		return result.Err
+	}
+
+	names := result.Made
+	if names == nil {
+		names = a.Wanted()
+	}
+	version := result.Version
+	if version == "" {
+		version = a.NextVersion
+	}
+	if version == "" {
+		version = "1-1"
+	}
+	if err := os.MkdirAll(a.Packages(), 0755); err != nil {
+		return errors.Wrapf(err, "faking make of %s", a.Name)
+	}
+	var paths []string
+	for _, n := range names {
+		p := path.Join(a.Packages(), fmt.Sprintf("%s-%s-x86_64.pkg.tar.gz", n, version))
+		if err := writeFakePkg(p, n, a.Base(), version); err != nil {
+			return errors.Wrapf(err, "faking make of %s", a.Name)
+		}
+		paths = append(paths, p)
+	}
+	a.PkgPaths = paths
+
+	f.mu.Lock()
+	f.made = append(f.made, a.Name)
+	f.mu.Unlock()
+	return nil
+}
+
+// Install records that a was installed, unless f.InstallErrs has an
+// error for it.
+func (f *Fake) Install(a *poltroon.AurPackage) error {
+	if err := f.InstallErrs[a.Name]; err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.installed = append(f.installed, a.Name)
+	f.mu.Unlock()
+	return nil
+}
+
+// UpstreamCommand runs name directly.
+func (f *Fake) UpstreamCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// RefreshSudo does nothing.
+func (f *Fake) RefreshSudo(interactive bool) error {
+	return nil
+}
+
+// Made returns the names of the packages made so far, in the order
+// they were made.
+func (f *Fake) Made() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.made...)
+}
+
+// Installed returns the names of the packages installed so far, in
+// the order they were installed.
+func (f *Fake) Installed() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.installed...)
+}
+
+// writeFakePkg writes a gzipped package file at p holding only a
+// .PKGINFO.
+func writeFakePkg(p, name, base, version string) (err error) {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	gz := gzip.NewWriter(f)
+	w := tar.NewWriter(gz)
+	info := fmt.Sprintf("pkgname = %s\npkgbase = %s\npkgver = %s\narch = x86_64\n", name, base, version)
+	h := &tar.Header{Name: ".PKGINFO", Mode: 0644, Size: int64(len(info)), Typeflag: tar.TypeReg}
+	if err = w.WriteHeader(h); err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte(info)); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
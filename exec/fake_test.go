@@ -0,0 +1,88 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/pkgfile"
+	"github.com/pkg/errors"
+)
+
+func TestFakeMake(t *testing.T) {
+	root, err := ioutil.TempDir("", "poltroon_exec_test")
+	ok(t, err)
+	defer os.RemoveAll(root)
+
+	split := poltroon.NewAurPackage(root, "foo", "1-1", "2-1", "")
+	split.PackageBase = "foo-base"
+	split.Members = []string{"foo-docs"}
+	broken := poltroon.NewAurPackage(root, "broken", "", "1-1", "")
+	slow := poltroon.NewAurPackage(root, "slow", "", "1-1", "")
+
+	f := &Fake{Results: map[string]FakeResult{
+		"broken": {Err: errors.New("no such source")},
+		"slow":   {Delay: time.Hour},
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ok(t, f.Make(ctx, split, false, Limits{}))
+	made, err := pkgfile.ReadAll(split.PkgPaths)
+	ok(t, err)
+	equals(t, []string(nil), pkgfile.Check(made, split.Wanted(), "foo-base", "2-1"))
+	files, err := split.PackageFiles()
+	ok(t, err)
+	equals(t, split.PkgPaths, files)
+
+	err = f.Make(ctx, broken, false, Limits{})
+	equals(t, "no such source", err.Error())
+
+	cancel()
+	err = f.Make(ctx, slow, false, Limits{})
+	equals(t, context.Canceled, errors.Cause(err))
+
+	ok(t, f.Install(split))
+	equals(t, []string{"foo"}, f.Made())
+	equals(t, []string{"foo"}, f.Installed())
+}
+
+func TestFakeSatisfied(t *testing.T) {
+	f := &Fake{Available: map[string]bool{"glibc": true}}
+	got, err := f.Satisfied([]string{"glibc", "libfoo"})
+	ok(t, err)
+	equals(t, map[string]bool{"glibc": true}, got)
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,310 @@
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Limits bound what makepkg may use while making a package.  Zero
+// means no limit.  How long it may take is up to the context passed
+// to Make.
+type Limits struct {
+	// Memory is in bytes.
+	Memory int64
+	// CPUs is how many CPUs worth of time makepkg may use.
+	CPUs float64
+}
+
+// LimitError is returned by Make when making a package was stopped
+// for going over one of its Limits, rather than failing on its own.
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+// Set in the environment of a command started by limiter.apply when
+// there is no cgroup to use, to tell the init function in sandbox.go
+// to limit memory with setrlimit and then run the command.
+const rlimitEnv = "POLTROON_RLIMIT_DATA"
+
+// limiter applies Limits to the commands run to make one package.
+// With cgroups v2, they all run in a new cgroup, which the kernel
+// holds to the limits as a whole.  Otherwise each process gets its
+// own memory limit from setrlimit, and CPUs can't be limited at all.
+type limiter struct {
+	limits Limits
+	// cgroup is the one made for the package, if any, and fd is open
+	// on it.
+	cgroup string
+	fd     *os.File
+}
+
+// newLimiter returns a limiter for l, with name used to name its
+// cgroup.  Anything about l that can't be applied is explained in
+// log.
+func newLimiter(l Limits, name string, log io.Writer) *limiter {
+	result := &limiter{limits: l}
+	if l == (Limits{}) {
+		return result
+	}
+	if parent := cgroupParent(); parent != "" {
+		dir := path.Join(parent, fmt.Sprintf("poltroon-%d-%s", os.Getpid(), name))
+		err := result.makeCgroup(dir)
+		if err == nil {
+			return result
+		}
+		fmt.Fprintf(log, "poltroon: unable to use cgroup %s, falling back to setrlimit: %v\n", dir, err)
+	}
+	if l.CPUs != 0 {
+		fmt.Fprintf(log, "poltroon: limiting CPUs needs cgroups v2 with the cpu controller, so it is not limited\n")
+	}
+	return result
+}
+
+// How often the cpu.max quota is handed out, in microseconds.
+const cpuPeriod = 100000
+
+// makeCgroup makes a cgroup at dir holding l.limits.
+func (l *limiter) makeCgroup(dir string) error {
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	l.cgroup = dir
+	if l.limits.Memory != 0 {
+		if err := writeCgroup(dir, "memory.max", strconv.FormatInt(l.limits.Memory, 10)); err != nil {
+			l.close()
+			return err
+		}
+		// Otherwise going over just means swapping.  Not every
+		// kernel has swap accounting.
+		if err := writeCgroup(dir, "memory.swap.max", "0"); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			l.close()
+			return err
+		}
+	}
+	if l.limits.CPUs != 0 {
+		quota := int64(l.limits.CPUs * cpuPeriod)
+		if err := writeCgroup(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			l.close()
+			return err
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		l.close()
+		return err
+	}
+	l.fd = fd
+	return nil
+}
+
+func writeCgroup(dir, name, value string) error {
+	return errors.Wrapf(ioutil.WriteFile(path.Join(dir, name), []byte(value), 0644), "setting %s", name)
+}
+
+// apply arranges for cmd to run under the limits.  It has to be
+// called once everything else about cmd is set up.  A nil limiter
+// does nothing.
+func (l *limiter) apply(cmd *exec.Cmd) error {
+	if l == nil {
+		return nil
+	}
+	if l.fd != nil {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(l.fd.Fd())
+		return nil
+	}
+	if l.limits.Memory == 0 {
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "limiting memory")
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, rlimitEnv+"="+strconv.FormatInt(l.limits.Memory, 10))
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	return nil
+}
+
+// check returns a LimitError in place of err if the cgroup ran out
+// of memory.  Without a cgroup, running out just looks like makepkg
+// failing.
+func (l *limiter) check(err error) error {
+	if err == nil || l.cgroup == "" || l.limits.Memory == 0 {
+		return err
+	}
+	if n, _ := cgroupEvent(l.cgroup, "memory.events", "oom_kill"); n != 0 {
+		return &LimitError{fmt.Sprintf("ran out of memory under its %d MiB limit", l.limits.Memory>>20)}
+	}
+	return err
+}
+
+// close kills anything left in the cgroup and removes it.
+func (l *limiter) close() {
+	if l.fd != nil {
+		l.fd.Close()
+		l.fd = nil
+	}
+	if l.cgroup == "" {
+		return
+	}
+	writeCgroup(l.cgroup, "cgroup.kill", "1")
+	// The cgroup can only be removed once the kernel is done with
+	// what was in it, which takes a moment after a kill.
+	for i := 0; i < 50; i++ {
+		if err := syscall.Rmdir(l.cgroup); err == nil || os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	l.cgroup = ""
+}
+
+// cgroupEvent returns the count of key in the flat keyed file name in
+// dir, such as memory.events.
+func cgroupEvent(dir, name, key string) (int64, error) {
+	f, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			return strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return 0, scanner.Err()
+}
+
+var (
+	cgroupOnce sync.Once
+	cgroupDir  string
+)
+
+// cgroupParent returns the cgroup v2 directory we are in if we can
+// make cgroups under it with the memory and cpu controllers, and ""
+// otherwise.
+func cgroupParent() string {
+	cgroupOnce.Do(func() {
+		cgroupDir = findCgroupParent("/proc/self/mounts", "/proc/self/cgroup")
+	})
+	return cgroupDir
+}
+
+// findCgroupParent does the work of cgroupParent, given the files
+// listing mounts and the cgroups we are in.
+func findCgroupParent(mounts, cgroups string) string {
+	mount := ""
+	readLines(mounts, func(line string) bool {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			mount = unescapeMountPoint(fields[1])
+			return false
+		}
+		return true
+	})
+	own := ""
+	readLines(cgroups, func(line string) bool {
+		if strings.HasPrefix(line, "0::") {
+			own = strings.TrimPrefix(line, "0::")
+			return false
+		}
+		return true
+	})
+	if mount == "" || own == "" {
+		return ""
+	}
+	dir := path.Join(mount, own)
+	if syscall.Access(dir, 2) != nil {
+		return ""
+	}
+
+	control := path.Join(dir, "cgroup.subtree_control")
+	if !hasControllers(control) {
+		// Only works if nothing else is in our cgroup, as in many
+		// containers.
+		ioutil.WriteFile(control, []byte("+memory +cpu"), 0644)
+		if !hasControllers(control) {
+			return ""
+		}
+	}
+	return dir
+}
+
+// hasControllers says whether the cgroup.subtree_control file at p
+// has the controllers a limiter uses.
+func hasControllers(p string) bool {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return false
+	}
+	found := map[string]bool{}
+	for _, c := range strings.Fields(string(b)) {
+		found[c] = true
+	}
+	return found["memory"] && found["cpu"]
+}
+
+// readLines calls f with each line of the file at p, until f returns
+// false.  A file that can't be read has no lines.
+func readLines(p string, f func(line string) bool) {
+	file, err := os.Open(p)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if !f(scanner.Text()) {
+			return
+		}
+	}
+}
+
+// runLimited runs in a command started by limiter.apply.  It limits
+// memory to limit bytes and then runs the command, as given by our
+// arguments.  It doesn't return.
+func runLimited(limit string) {
+	n, err := strconv.ParseUint(limit, 10, 64)
+	if err == nil {
+		err = syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: n, Max: n})
+	}
+	if err == nil && len(os.Args) < 3 {
+		err = errors.New("no command to run")
+	}
+	if err == nil {
+		var env []string
+		for _, e := range os.Environ() {
+			if !strings.HasPrefix(e, rlimitEnv+"=") {
+				env = append(env, e)
+			}
+		}
+		err = syscall.Exec(os.Args[1], os.Args[2:], env)
+	}
+	fmt.Fprintf(os.Stderr, "poltroon limits: %+v\n", err)
+	os.Exit(127)
+}
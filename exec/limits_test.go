@@ -0,0 +1,77 @@
+package exec
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestFindCgroupParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_limits_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	mounts := path.Join(dir, "mounts")
+	ok(t, ioutil.WriteFile(mounts, []byte("proc /proc proc rw 0 0\ncgroup2 "+dir+"/cg cgroup2 rw 0 0\n"), 0644))
+	cgroups := path.Join(dir, "cgroup")
+	ok(t, ioutil.WriteFile(cgroups, []byte("1:name=systemd:/\n0::/user/build\n"), 0644))
+	own := path.Join(dir, "cg", "user", "build")
+	ok(t, os.MkdirAll(own, 0755))
+
+	control := path.Join(own, "cgroup.subtree_control")
+	ok(t, ioutil.WriteFile(control, []byte("cpu io memory\n"), 0644))
+	equals(t, own, findCgroupParent(mounts, cgroups))
+
+	ok(t, ioutil.WriteFile(control, []byte("io\n"), 0644))
+	equals(t, "", findCgroupParent(mounts, cgroups))
+
+	equals(t, "", findCgroupParent(path.Join(dir, "missing"), cgroups))
+}
+
+func TestLimiterCgroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_limits_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	cgroup := path.Join(dir, "poltroon-1-foo")
+	l := &limiter{limits: Limits{Memory: 1 << 30, CPUs: 1.5}}
+	ok(t, l.makeCgroup(cgroup))
+	defer l.fd.Close()
+	for name, want := range map[string]string{
+		"memory.max":      "1073741824",
+		"memory.swap.max": "0",
+		"cpu.max":         "150000 100000",
+	} {
+		got, err := ioutil.ReadFile(path.Join(cgroup, name))
+		ok(t, err)
+		equals(t, want, string(got))
+	}
+
+	failed := errors.New("exit status 1")
+	events := path.Join(cgroup, "memory.events")
+	ok(t, ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"), 0644))
+	equals(t, failed, l.check(failed))
+	ok(t, ioutil.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0644))
+	err = l.check(failed)
+	limitErr, isLimit := err.(*LimitError)
+	assert(t, isLimit, "expected a LimitError, not %v", err)
+	equals(t, "ran out of memory under its 1024 MiB limit", limitErr.Reason)
+}
+
+func TestLimiterRlimit(t *testing.T) {
+	l := &limiter{limits: Limits{Memory: 64 << 20}}
+	cmd := exec.Command("/bin/sh", "-c", "ulimit -d")
+	ok(t, l.apply(cmd))
+	out, err := cmd.CombinedOutput()
+	ok(t, err)
+	equals(t, "65536\n", string(out))
+
+	var nothing *limiter
+	cmd = exec.Command("/bin/sh", "-c", "exit 0")
+	ok(t, nothing.apply(cmd))
+	equals(t, "/bin/sh", cmd.Path)
+}
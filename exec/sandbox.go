@@ -0,0 +1,506 @@
+package exec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Sandbox runs commands where they can see the rest of the system
+// only read-only, can't see the user's home directory and can write
+// only to the directories they are given.  It uses bubblewrap if that
+// is installed, and user and mount namespaces directly otherwise.
+type Sandbox struct {
+	// Offline cuts the network off once sources are downloaded.
+	Offline bool
+
+	// empty if we set up the namespaces ourselves
+	bwrapPath string
+}
+
+// NewSandbox returns a Sandbox, or an error if this system can't
+// provide one.
+func NewSandbox(offline bool) (*Sandbox, error) {
+	s := &Sandbox{Offline: offline}
+	if p, err := exec.LookPath("bwrap"); err == nil {
+		s.bwrapPath = p
+		return s, nil
+	}
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		return nil, errors.Wrap(err, "sandboxing needs user namespaces or bwrap")
+	}
+	return s, nil
+}
+
+// Set in the environment of a sandboxed command started without
+// bubblewrap, to tell the init function below to set the sandbox up
+// and then run the command.
+const sandboxEnv = "POLTROON_SANDBOX_SPEC"
+
+// sandboxSpec says what a sandboxed command can see and what to run.
+type sandboxSpec struct {
+	// Root, if set, is a directory to use as the root, which can be
+	// written to.  Otherwise the root is a read-only view of /.
+	Root string
+	// AsRoot runs the command as root in the sandbox.  Outside, it is
+	// still us.
+	AsRoot bool
+	// Empty holds directories replaced with empty ones.
+	Empty []emptyDir
+	// Binds holds files and directories from outside to make visible,
+	// after Empty is applied.
+	Binds []bindMount
+	Dir   string
+	Path  string
+	Args  []string
+}
+
+type emptyDir struct {
+	Path string
+	Mode uint32
+}
+
+type bindMount struct {
+	Source   string
+	Dest     string
+	ReadOnly bool
+}
+
+// command returns a command that runs name with args in dir, inside
+// the sandbox, with writable as the only directories it can change.
+// If network is false, the command can't reach the network.  The
+// command's Env is set, and may be added to.
+func (s *Sandbox) command(ctx context.Context, dir string, writable []string, network bool, name string, args ...string) *exec.Cmd {
+	return s.specCommand(ctx, newSandboxSpec(dir, writable, name, args), network, os.Environ())
+}
+
+// upstreamCommand returns a command that runs name with args in the
+// sandbox, with the network but nowhere to write.
+func (s *Sandbox) upstreamCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	// The sandbox needs a path.  If there isn't one, running name
+	// fails as it would have anyway.
+	if p, err := exec.LookPath(name); err == nil {
+		name = p
+	}
+	return s.command(ctx, "/", nil, true, name, args...)
+}
+
+// specCommand returns a command that runs what spec says, in the
+// sandbox it describes, with env as its environment.
+func (s *Sandbox) specCommand(ctx context.Context, spec *sandboxSpec, network bool, env []string) *exec.Cmd {
+	if s.bwrapPath != "" {
+		return s.bwrapCommand(ctx, spec, network, env)
+	}
+
+	cmd := exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Args = []string{"poltroon-sandbox"}
+	encoded, _ := json.Marshal(spec)
+	cmd.Env = append(append([]string{}, env...), sandboxEnv+"="+string(encoded))
+	uid, gid := os.Getuid(), os.Getgid()
+	if spec.AsRoot {
+		uid, gid = 0, 0
+	}
+	cloneflags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS)
+	if !network {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		// A new session leaves the terminal behind, so nothing can
+		// be pushed into its input.  The session is also a process
+		// group, which can be killed as a whole.
+		Setsid:     true,
+		Cloneflags: cloneflags,
+		// Files made are ours either way.
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: uid, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: gid, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+		// Needed to set up the mounts, and dropped before running
+		// the command.
+		AmbientCaps: []uintptr{capSysAdmin},
+	}
+	return cmd
+}
+
+// Linux capability number, from linux/capability.h
+const capSysAdmin = 21
+
+func (s *Sandbox) bwrapCommand(ctx context.Context, spec *sandboxSpec, network bool, env []string) *exec.Cmd {
+	args := []string{"--ro-bind", "/", "/"}
+	if spec.Root != "" {
+		args = []string{"--bind", spec.Root, "/"}
+	}
+	args = append(args, "--dev", "/dev", "--proc", "/proc")
+	for _, e := range spec.Empty {
+		args = append(args, "--tmpfs", e.Path)
+	}
+	for _, b := range spec.Binds {
+		if b.ReadOnly {
+			args = append(args, "--ro-bind", b.Source, b.Dest)
+		} else {
+			args = append(args, "--bind", b.Source, b.Dest)
+		}
+	}
+	if spec.AsRoot {
+		args = append(args, "--uid", "0", "--gid", "0")
+	}
+	args = append(args,
+		"--chdir", spec.Dir,
+		"--unshare-user", "--unshare-ipc", "--unshare-pid", "--unshare-uts", "--unshare-cgroup-try")
+	if !network {
+		args = append(args, "--unshare-net")
+	}
+	// With its own pid namespace, everything in the sandbox dies
+	// along with bwrap.
+	args = append(args, "--die-with-parent", "--new-session", "--")
+	args = append(args, spec.Path)
+	args = append(args, spec.Args[1:]...)
+
+	cmd := exec.CommandContext(ctx, s.bwrapPath, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append([]string{}, env...)
+	return cmd
+}
+
+func newSandboxSpec(dir string, writable []string, name string, args []string) *sandboxSpec {
+	spec := &sandboxSpec{
+		Dir:  dir,
+		Path: name,
+		Args: append([]string{name}, args...),
+	}
+	for _, w := range writable {
+		spec.Binds = append(spec.Binds, bindMount{Source: w, Dest: w})
+	}
+	for _, d := range []string{"/tmp", "/var/tmp", "/dev/shm"} {
+		if _, err := os.Stat(d); err == nil {
+			spec.Empty = append(spec.Empty, emptyDir{d, 01777})
+		}
+	}
+	private := []string{fmt.Sprintf("/run/user/%d", os.Getuid())}
+	home := os.Getenv("HOME")
+	if home != "" && home != "/" {
+		private = append(private, home)
+		// makepkg settings, and keys for checking sources.
+		config := os.Getenv("XDG_CONFIG_HOME")
+		if config == "" {
+			config = path.Join(home, ".config")
+		}
+		for _, r := range []string{
+			path.Join(home, ".makepkg.conf"),
+			path.Join(config, "pacman", "makepkg.conf"),
+			path.Join(home, ".gnupg"),
+		} {
+			if _, err := os.Stat(r); err == nil {
+				spec.Binds = append(spec.Binds, bindMount{Source: r, Dest: r, ReadOnly: true})
+			}
+		}
+	}
+	for _, p := range private {
+		if _, err := os.Stat(p); err == nil {
+			spec.Empty = append(spec.Empty, emptyDir{p, 0700})
+		}
+	}
+	return spec
+}
+
+func init() {
+	// Limits come first, so that they cover the sandbox too.
+	if limit := os.Getenv(rlimitEnv); limit != "" {
+		runLimited(limit)
+	}
+	if encoded := os.Getenv(sandboxEnv); encoded != "" {
+		runSandboxed(encoded)
+	}
+}
+
+// runSandboxed runs in the new namespaces made by command.  It sets
+// up the sandbox described by encoded and runs the command in it.
+// It doesn't return.
+func runSandboxed(encoded string) {
+	var spec sandboxSpec
+	err := json.Unmarshal([]byte(encoded), &spec)
+	if err == nil {
+		err = enterSandbox(&spec)
+	}
+	if err == nil {
+		var env []string
+		for _, e := range os.Environ() {
+			if !strings.HasPrefix(e, sandboxEnv+"=") {
+				env = append(env, e)
+			}
+		}
+		err = syscall.Exec(spec.Path, spec.Args, env)
+	}
+	fmt.Fprintf(os.Stderr, "poltroon sandbox: %+v\n", err)
+	os.Exit(127)
+}
+
+// The sandbox is put together in a tmpfs mounted here, which nothing
+// can see once we are done.
+const scratch = "/tmp"
+
+// enterSandbox builds a new root for spec and switches to it, then
+// drops the privileges it needed to do that.
+func enterSandbox(spec *sandboxSpec) error {
+	// Mounts and the current directory apply to every thread, but the
+	// capabilities we drop at the end don't.
+	runtime.LockOSThread()
+
+	// What we bind may be under scratch, so we hold onto it before
+	// it gets covered up.
+	sources := make([]*os.File, len(spec.Binds))
+	for i, b := range spec.Binds {
+		f, err := openPath(b.Source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sources[i] = f
+	}
+	base := "/"
+	if spec.Root != "" {
+		f, err := openPath(spec.Root)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		base = fdPath(f)
+	}
+
+	// Nothing we do should be seen outside.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "making mounts private")
+	}
+	if err := syscall.Mount("tmpfs", scratch, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0700"); err != nil {
+		return errors.Wrapf(err, "mounting tmpfs on %s", scratch)
+	}
+	root := path.Join(scratch, "root")
+	if err := os.Mkdir(root, 0700); err != nil {
+		return err
+	}
+	if err := syscall.Mount(base, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "binding %s", base)
+	}
+
+	if spec.Root == "" {
+		if err := readOnlyUnder(root); err != nil {
+			return err
+		}
+	} else {
+		// The system's, since the root has no way to make its own.
+		for _, d := range []string{"/dev", "/proc", "/sys"} {
+			dest := path.Join(root, d)
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+			if err := syscall.Mount(d, dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+				return errors.Wrapf(err, "binding %s", d)
+			}
+		}
+	}
+
+	for _, e := range spec.Empty {
+		// Already there, unless it is under another empty directory.
+		dest := path.Join(root, e.Path)
+		if err := os.MkdirAll(dest, 0700); err != nil {
+			return err
+		}
+		opts := fmt.Sprintf("mode=%04o", e.Mode)
+		if err := syscall.Mount("tmpfs", dest, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, opts); err != nil {
+			return errors.Wrapf(err, "mounting tmpfs on %s", e.Path)
+		}
+	}
+	for i, b := range spec.Binds {
+		dest := path.Join(root, b.Dest)
+		if err := makeMountPoint(sources[i], dest); err != nil {
+			return errors.Wrapf(err, "making mount point for %s", b.Dest)
+		}
+		if err := syscall.Mount(fdPath(sources[i]), dest, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return errors.Wrapf(err, "binding %s", b.Source)
+		}
+		if b.ReadOnly {
+			if err := remountReadOnly(dest); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return errors.Wrap(err, "pivot_root")
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return errors.Wrap(err, "detaching old root")
+	}
+	if err := os.Chdir(spec.Dir); err != nil {
+		return err
+	}
+
+	// Nothing run from here on gets any privileges back, from setuid
+	// programs or otherwise.
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return errors.Wrap(errno, "setting no_new_privs")
+	}
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 {
+		return errors.Wrap(errno, "clearing ambient capabilities")
+	}
+	return nil
+}
+
+// readOnlyUnder makes every mount at or under root read-only, other
+// than the ones the kernel makes for us, which hold nothing an
+// unprivileged user can change.
+func readOnlyUnder(root string) error {
+	mounts, err := mountPoints(root)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		rel := strings.TrimPrefix(m, root)
+		if within("/proc", rel) || within("/sys", rel) || within("/dev", rel) {
+			continue
+		}
+		if err := remountReadOnly(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openPath opens p just to refer to it later.
+func openPath(p string) (*os.File, error) {
+	f, err := os.OpenFile(p, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", p)
+	}
+	return f, nil
+}
+
+// fdPath returns a path that refers to f, wherever it is.
+func fdPath(f *os.File) string {
+	return "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+}
+
+// From asm-generic/fcntl.h, which syscall leaves out.
+const oPath = 0x200000
+
+// From linux/prctl.h
+const (
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+)
+
+func within(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// makeMountPoint makes sure there is something at dest to mount f on.
+func makeMountPoint(f *os.File, dest string) error {
+	info, err := os.Stat(fdPath(f))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(dest, 0700)
+	}
+	if err = os.MkdirAll(path.Dir(dest), 0700); err != nil {
+		return err
+	}
+	if _, err = os.Stat(dest); err == nil {
+		return nil
+	}
+	created, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return created.Close()
+}
+
+// mountPoints returns every mount point at or under dir.
+func mountPoints(dir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var result []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point is the fifth field.  See proc(5).
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		m := unescapeMountPoint(fields[4])
+		if within(dir, m) {
+			result = append(result, m)
+		}
+	}
+	return result, scanner.Err()
+}
+
+// unescapeMountPoint undoes the octal escapes, such as \040 for a
+// space, in a mount point from mountinfo.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Flags from statfs, from sys/statvfs.h, and the matching mount
+// flags.  Inside a user namespace, these can't be cleared when
+// remounting something mounted outside.
+var lockedFlags = []struct{ st, ms uintptr }{
+	{0x2, syscall.MS_NOSUID},
+	{0x4, syscall.MS_NODEV},
+	{0x8, syscall.MS_NOEXEC},
+	{0x400, syscall.MS_NOATIME},
+	{0x800, syscall.MS_NODIRATIME},
+	{0x1000, syscall.MS_RELATIME},
+}
+
+// remountReadOnly makes the bind mount at p read-only.
+func remountReadOnly(p string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		if os.IsPermission(err) || os.IsNotExist(err) {
+			// Hidden from us anyway, or mounted over.
+			return nil
+		}
+		return errors.Wrapf(err, "checking %s", p)
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range lockedFlags {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if err := syscall.Mount("", p, "", flags, ""); err != nil {
+		return errors.Wrapf(err, "making %s read-only", p)
+	}
+	return nil
+}
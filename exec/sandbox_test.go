@@ -0,0 +1,82 @@
+package exec
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// sandboxed runs script with sh in s, with w as its directory and the
+// only one it can write to.
+func sandboxed(t *testing.T, s *Sandbox, w string, network bool, script string) string {
+	cmd := s.command(context.Background(), w, []string{w}, network, "/bin/sh", "-c", script)
+	out, err := cmd.CombinedOutput()
+	if err != nil && strings.Contains(string(out), "poltroon sandbox:") {
+		t.Skipf("unable to make namespaces here: %s", out)
+	}
+	ok(t, err)
+	return string(out)
+}
+
+func TestSandbox(t *testing.T) {
+	home, err := ioutil.TempDir("", "poltroon_sandbox_home")
+	ok(t, err)
+	defer os.RemoveAll(home)
+	ok(t, ioutil.WriteFile(path.Join(home, "secret"), []byte("secret"), 0600))
+	w := path.Join(home, "build")
+	ok(t, os.Mkdir(w, 0700))
+
+	wd, err := os.Getwd()
+	ok(t, err)
+	probe := path.Join(wd, "sandbox_probe")
+	defer os.Remove(probe)
+
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	defer os.Setenv("HOME", oldHome)
+
+	s := &Sandbox{}
+	out := sandboxed(t, s, w, true, `
+		pwd
+		echo made > out
+		cat "$HOME/secret" 2>/dev/null || echo hidden
+		touch `+probe+` 2>/dev/null || echo read-only
+		touch /tmp/scratch && echo tmp
+	`)
+	equals(t, w+"\nhidden\nread-only\ntmp\n", out)
+	made, err := ioutil.ReadFile(path.Join(w, "out"))
+	ok(t, err)
+	equals(t, "made\n", string(made))
+	_, err = os.Stat(probe)
+	assert(t, os.IsNotExist(err), "sandbox wrote %s", probe)
+
+	// Only loopback is left without the network.
+	out = sandboxed(t, s, w, false, `tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '`)
+	equals(t, "lo\n", out)
+}
+
+func TestUpstreamCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_sandbox_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	probe := path.Join(dir, "probe")
+
+	s := &Sandbox{}
+	out, err := s.upstreamCommand(context.Background(), "sh", "-c", "touch "+probe+" 2>/dev/null || echo read-only").CombinedOutput()
+	if err != nil && strings.Contains(string(out), "poltroon sandbox:") {
+		t.Skipf("unable to make namespaces here: %s", out)
+	}
+	ok(t, err)
+	equals(t, "read-only\n", string(out))
+	_, err = os.Stat(probe)
+	assert(t, os.IsNotExist(err), "sandbox wrote %s", probe)
+}
+
+func TestUnescapeMountPoint(t *testing.T) {
+	equals(t, "/mnt/with space", unescapeMountPoint(`/mnt/with\040space`))
+	equals(t, `/mnt/back\slash`, unescapeMountPoint(`/mnt/back\134slash`))
+	equals(t, "/plain", unescapeMountPoint("/plain"))
+}
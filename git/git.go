@@ -0,0 +1,84 @@
+// Package git keeps local clones of package repositories up to date,
+// by running the git command.
+package git
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Repo is a local clone of a remote repository.
+type Repo struct {
+	// Dir is the directory holding the clone.  Clones are bare, since
+	// we only ever export from them.
+	Dir string
+	// URL is where the clone came from.
+	URL string
+}
+
+// Sync makes dir a bare clone of url, or if it already is one, fetches
+// whatever is new.  url may be anything git understands, including
+// the path of a local repository.
+func Sync(ctx context.Context, url, dir string) (*Repo, error) {
+	r := &Repo{dir, url}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err = run(ctx, "", "clone", "--quiet", "--bare", url, dir); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+	// A bare clone doesn't set up remote tracking, so we say exactly
+	// what we want.
+	if _, err := run(ctx, dir, "fetch", "--quiet", "--prune", "--force", url, "+refs/heads/*:refs/heads/*"); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Resolve returns the full commit hash for rev, which may be anything
+// git rev-parse accepts.  An empty rev means HEAD.
+func (r *Repo) Resolve(ctx context.Context, rev string) (string, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	out, err := run(ctx, r.Dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", errors.Wrapf(err, "unknown revision %q", rev)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Archive writes a tar file of the tree at commit to w, with every
+// name prefixed by prefix, which should end with a slash.
+func (r *Repo) Archive(ctx context.Context, commit, prefix string, w io.Writer) error {
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar", "--prefix="+prefix, commit)
+	cmd.Dir = r.Dir
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "git archive %s: %s", commit, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// run runs git with args in dir, returning its stdout.
+func run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Never wait for someone to type a password.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "git %s: %s", strings.Join(args, " "), bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
@@ -0,0 +1,118 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/ginabythebay/poltroon/tar"
+)
+
+// gitCmd runs git in dir, as a test user.
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	ok(t, err)
+	return string(bytes.TrimSpace(out))
+}
+
+// commit writes a PKGBUILD with contents to work, commits it and
+// pushes it to the work's origin, returning the commit hash.
+func commit(t *testing.T, work, contents string) string {
+	ok(t, ioutil.WriteFile(path.Join(work, "PKGBUILD"), []byte(contents), 0644))
+	gitCmd(t, work, "add", "PKGBUILD")
+	gitCmd(t, work, "commit", "--quiet", "-m", contents)
+	gitCmd(t, work, "push", "--quiet", "origin", "HEAD:master")
+	return gitCmd(t, work, "rev-parse", "HEAD")
+}
+
+func checkout(t *testing.T, r *Repo, commit string) string {
+	dest, err := ioutil.TempDir("", "poltroon_git_checkout")
+	ok(t, err)
+	defer os.RemoveAll(dest)
+	var buf bytes.Buffer
+	ok(t, r.Archive(context.Background(), commit, "foo/", &buf))
+	ok(t, tar.ExtractAll(&buf, dest))
+	b, err := ioutil.ReadFile(path.Join(dest, "foo", "PKGBUILD"))
+	ok(t, err)
+	return string(b)
+}
+
+func TestSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_git_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// A local bare repository stands in for the AUR.
+	origin := path.Join(dir, "foo.git")
+	gitCmd(t, dir, "init", "--quiet", "--bare", "--initial-branch=master", origin)
+	work := path.Join(dir, "work")
+	gitCmd(t, dir, "clone", "--quiet", origin, work)
+	first := commit(t, work, "pkgver=1")
+
+	ctx := context.Background()
+	clone := path.Join(dir, "cache", "foo")
+	r, err := Sync(ctx, origin, clone)
+	ok(t, err)
+	head, err := r.Resolve(ctx, "")
+	ok(t, err)
+	equals(t, first, head)
+	equals(t, "pkgver=1", checkout(t, r, head))
+
+	second := commit(t, work, "pkgver=2")
+	r, err = Sync(ctx, origin, clone)
+	ok(t, err)
+	head, err = r.Resolve(ctx, "")
+	ok(t, err)
+	equals(t, second, head)
+	equals(t, "pkgver=2", checkout(t, r, head))
+
+	// Older commits are still there to go back to.
+	old, err := r.Resolve(ctx, first[:8])
+	ok(t, err)
+	equals(t, first, old)
+	equals(t, "pkgver=1", checkout(t, r, old))
+
+	_, err = r.Resolve(ctx, "nosuchcommit")
+	assert(t, err != nil, "expected an error resolving an unknown commit")
+
+	_, err = Sync(ctx, path.Join(dir, "missing.git"), path.Join(dir, "cache", "missing"))
+	assert(t, err != nil, "expected an error cloning a missing repository")
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,41 @@
+package poltroon
+
+import (
+	"path"
+)
+
+// IgnoreList decides which packages should be left alone when
+// updating.  Entries may be shell patterns, as in pacman.conf.
+type IgnoreList struct {
+	Pkgs   []string
+	Groups []string
+}
+
+// Add adds more packages and groups to the list.
+func (l *IgnoreList) Add(pkgs, groups []string) {
+	l.Pkgs = append(l.Pkgs, pkgs...)
+	l.Groups = append(l.Groups, groups...)
+}
+
+// Ignored returns true if a package with the given name, belonging to
+// groups, should be ignored.
+func (l *IgnoreList) Ignored(name string, groups []string) bool {
+	if matchAny(l.Pkgs, name) {
+		return true
+	}
+	for _, g := range groups {
+		if matchAny(l.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if matched, err := path.Match(p, s); p == s || (err == nil && matched) {
+			return true
+		}
+	}
+	return false
+}
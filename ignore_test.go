@@ -0,0 +1,17 @@
+package poltroon
+
+import (
+	"testing"
+)
+
+func TestIgnoreList(t *testing.T) {
+	l := &IgnoreList{}
+	l.Add([]string{"linux-*", "foo"}, nil)
+	l.Add(nil, []string{"kde"})
+
+	assert(t, l.Ignored("foo", nil), "foo should be ignored")
+	assert(t, l.Ignored("linux-git", nil), "linux-git should be ignored")
+	assert(t, !l.Ignored("linux", nil), "linux should not be ignored")
+	assert(t, l.Ignored("dolphin", []string{"apps", "kde"}), "dolphin should be ignored by group")
+	assert(t, !l.Ignored("bar", []string{"apps"}), "bar should not be ignored")
+}
@@ -0,0 +1,159 @@
+package pacdb
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reason says why a package is installed.
+type Reason int
+
+// Install reasons, as pacman stores them.
+const (
+	Explicit   Reason = 0
+	Dependency Reason = 1
+)
+
+// Package holds what a database knows about one package.  Fields not
+// present in a particular database are left empty.
+type Package struct {
+	Name        string
+	Version     string
+	Base        string
+	Description string
+	URL         string
+	Arch        string
+	Packager    string
+	// Filename is only present in sync databases.
+	Filename string
+	Size     int64
+
+	BuildDate   time.Time
+	InstallDate time.Time
+	Reason      Reason
+
+	Groups      []string
+	License     []string
+	Depends     []string
+	OptDepends  []string
+	Provides    []string
+	Conflicts   []string
+	Replaces    []string
+	MakeDepends []string
+}
+
+// ReadDesc parses a desc file from a pacman database.
+func ReadDesc(r io.Reader) (*Package, error) {
+	p := &Package{}
+	if err := parseDesc(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseDesc parses a desc file, which is made of sections like
+//
+//	%NAME%
+//	foo
+//
+// with one value per line, ending with a blank line.  Sections we
+// don't know about are ignored.
+func parseDesc(r io.Reader, p *Package) error {
+	sections, err := readSections(r)
+	if err != nil {
+		return err
+	}
+	for key, values := range sections {
+		if err := p.set(key, values); err != nil {
+			return errors.Wrapf(err, "section %%%s%%", key)
+		}
+	}
+	return nil
+}
+
+// readSections turns a desc file into a map from section name to
+// the lines in that section.
+func readSections(r io.Reader) (map[string][]string, error) {
+	result := map[string][]string{}
+	scanner := bufio.NewScanner(r)
+	key := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			key = ""
+		case key == "" && len(line) > 2 && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			key = line[1 : len(line)-1]
+			result[key] = []string{}
+		case key != "":
+			result[key] = append(result[key], line)
+		}
+	}
+	return result, scanner.Err()
+}
+
+func (p *Package) set(key string, values []string) error {
+	single := ""
+	if len(values) > 0 {
+		single = values[0]
+	}
+	var err error
+	switch key {
+	case "NAME":
+		p.Name = single
+	case "VERSION":
+		p.Version = single
+	case "BASE":
+		p.Base = single
+	case "DESC":
+		p.Description = single
+	case "URL":
+		p.URL = single
+	case "ARCH":
+		p.Arch = single
+	case "PACKAGER":
+		p.Packager = single
+	case "FILENAME":
+		p.Filename = single
+	case "SIZE", "ISIZE":
+		p.Size, err = strconv.ParseInt(single, 10, 64)
+	case "BUILDDATE":
+		p.BuildDate, err = parseTime(single)
+	case "INSTALLDATE":
+		p.InstallDate, err = parseTime(single)
+	case "REASON":
+		var reason int
+		reason, err = strconv.Atoi(single)
+		p.Reason = Reason(reason)
+	case "GROUPS":
+		p.Groups = values
+	case "LICENSE":
+		p.License = values
+	case "DEPENDS":
+		p.Depends = values
+	case "OPTDEPENDS":
+		p.OptDepends = values
+	case "PROVIDES":
+		p.Provides = values
+	case "CONFLICTS":
+		p.Conflicts = values
+	case "REPLACES":
+		p.Replaces = values
+	case "MAKEDEPENDS":
+		p.MakeDepends = values
+	}
+	return err
+}
+
+func parseTime(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0).UTC(), nil
+}
@@ -0,0 +1,157 @@
+// Package pacdb reads the pacman local and sync databases directly,
+// without running pacman.
+package pacdb
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	ptar "github.com/ginabythebay/poltroon/tar"
+	"github.com/pkg/errors"
+)
+
+// DefaultDBPath is where pacman keeps its databases unless
+// configured otherwise.
+const DefaultDBPath = "/var/lib/pacman"
+
+// DB reads the databases under a pacman DBPath.
+type DB struct {
+	// DBPath holds the local and sync directories.
+	DBPath string
+}
+
+// New returns a DB for dbPath.
+func New(dbPath string) *DB {
+	return &DB{dbPath}
+}
+
+// Local returns every installed package, sorted by name.
+func (db *DB) Local() ([]*Package, error) {
+	localDir := path.Join(db.DBPath, "local")
+	entries, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", localDir)
+	}
+	result := []*Package{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			// e.g. ALPM_DB_VERSION
+			continue
+		}
+		descPath := path.Join(localDir, e.Name(), "desc")
+		p, err := readDescFile(descPath)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	sort.Sort(byName(result))
+	return result, nil
+}
+
+// Sync returns the packages in every sync database, keyed by
+// repository name.
+func (db *DB) Sync() (map[string][]*Package, error) {
+	matches, err := filepath.Glob(path.Join(db.DBPath, "sync", "*.db"))
+	if err != nil {
+		return nil, errors.Wrap(err, "globbing sync databases")
+	}
+	result := map[string][]*Package{}
+	for _, m := range matches {
+		pkgs, err := readSyncDB(m)
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimSuffix(path.Base(m), ".db")] = pkgs
+	}
+	return result, nil
+}
+
+// Foreign returns every installed package whose name isn't in any sync
+// database, sorted by name.  This is what pacman --query --foreign
+// reports.
+func (db *DB) Foreign() ([]*Package, error) {
+	local, err := db.Local()
+	if err != nil {
+		return nil, err
+	}
+	sync, err := db.Sync()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, pkgs := range sync {
+		for _, p := range pkgs {
+			known[p.Name] = true
+		}
+	}
+	result := []*Package{}
+	for _, p := range local {
+		if !known[p.Name] {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+func readDescFile(descPath string) (*Package, error) {
+	f, err := os.Open(descPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", descPath)
+	}
+	defer f.Close()
+	p := &Package{}
+	if err = parseDesc(f, p); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", descPath)
+	}
+	return p, nil
+}
+
+// readSyncDB reads a sync database, which is a possibly compressed
+// tar file with a directory per package, each holding a desc file.
+func readSyncDB(dbPath string) ([]*Package, error) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", dbPath)
+	}
+	defer f.Close()
+	decompressed, err := ptar.Decompress(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing %s", dbPath)
+	}
+	defer decompressed.Close()
+
+	result := []*Package{}
+	r := tar.NewReader(decompressed)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", dbPath)
+		}
+		if path.Base(h.Name) != "desc" {
+			continue
+		}
+		p := &Package{}
+		if err = parseDesc(r, p); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s in %s", h.Name, dbPath)
+		}
+		result = append(result, p)
+	}
+	sort.Sort(byName(result))
+	return result, nil
+}
+
+type byName []*Package
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
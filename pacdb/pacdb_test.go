@@ -0,0 +1,191 @@
+package pacdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+const fooDesc = `%NAME%
+foo
+
+%VERSION%
+1.0-1
+
+%BASE%
+foo-base
+
+%DESC%
+A foo package
+
+%ARCH%
+x86_64
+
+%BUILDDATE%
+1500000000
+
+%INSTALLDATE%
+1500000100
+
+%PACKAGER%
+Gina <gina@example.com>
+
+%SIZE%
+2048
+
+%REASON%
+1
+
+%LICENSE%
+MIT
+BSD
+
+%DEPENDS%
+glibc
+bar>=2
+
+%UNKNOWN%
+ignored
+
+`
+
+const barDesc = `%NAME%
+bar
+
+%VERSION%
+2-1
+
+`
+
+const syncBarDesc = `%FILENAME%
+bar-2-1-x86_64.pkg.tar.zst
+
+%NAME%
+bar
+
+%VERSION%
+2-1
+
+%GROUPS%
+base-devel
+
+`
+
+// makeDBPath lays out a fake pacman DBPath with foo and bar
+// installed, and bar available from the core repository.
+func makeDBPath(t *testing.T) string {
+	dbPath, err := ioutil.TempDir("", "poltroon_pacdb_test")
+	ok(t, err)
+	for dir, desc := range map[string]string{"foo-1.0-1": fooDesc, "bar-2-1": barDesc} {
+		ok(t, os.MkdirAll(path.Join(dbPath, "local", dir), 0755))
+		ok(t, ioutil.WriteFile(path.Join(dbPath, "local", dir, "desc"), []byte(desc), 0644))
+	}
+	ok(t, ioutil.WriteFile(path.Join(dbPath, "local", "ALPM_DB_VERSION"), []byte("9\n"), 0644))
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	ok(t, tw.WriteHeader(&tar.Header{Name: "bar-2-1/", Typeflag: tar.TypeDir, Mode: 0755}))
+	ok(t, tw.WriteHeader(&tar.Header{Name: "bar-2-1/desc", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(syncBarDesc))}))
+	_, err = tw.Write([]byte(syncBarDesc))
+	ok(t, err)
+	ok(t, tw.Close())
+	ok(t, gz.Close())
+	ok(t, os.MkdirAll(path.Join(dbPath, "sync"), 0755))
+	ok(t, ioutil.WriteFile(path.Join(dbPath, "sync", "core.db"), buf.Bytes(), 0644))
+	return dbPath
+}
+
+func TestLocal(t *testing.T) {
+	dbPath := makeDBPath(t)
+	defer os.RemoveAll(dbPath)
+
+	local, err := New(dbPath).Local()
+	ok(t, err)
+	equals(t, 2, len(local))
+	equals(t, &Package{Name: "bar", Version: "2-1"}, local[0])
+	equals(t, &Package{
+		Name:        "foo",
+		Version:     "1.0-1",
+		Base:        "foo-base",
+		Description: "A foo package",
+		Arch:        "x86_64",
+		Packager:    "Gina <gina@example.com>",
+		Size:        2048,
+		BuildDate:   time.Unix(1500000000, 0).UTC(),
+		InstallDate: time.Unix(1500000100, 0).UTC(),
+		Reason:      Dependency,
+		License:     []string{"MIT", "BSD"},
+		Depends:     []string{"glibc", "bar>=2"},
+	}, local[1])
+}
+
+func TestSync(t *testing.T) {
+	dbPath := makeDBPath(t)
+	defer os.RemoveAll(dbPath)
+
+	sync, err := New(dbPath).Sync()
+	ok(t, err)
+	equals(t, map[string][]*Package{
+		"core": []*Package{
+			&Package{
+				Name:     "bar",
+				Version:  "2-1",
+				Filename: "bar-2-1-x86_64.pkg.tar.zst",
+				Groups:   []string{"base-devel"},
+			},
+		},
+	}, sync)
+}
+
+func TestForeign(t *testing.T) {
+	dbPath := makeDBPath(t)
+	defer os.RemoveAll(dbPath)
+
+	foreign, err := New(dbPath).Foreign()
+	ok(t, err)
+	equals(t, 1, len(foreign))
+	equals(t, "foo", foreign[0].Name)
+}
+
+func TestBadDesc(t *testing.T) {
+	p := &Package{}
+	err := parseDesc(bytes.NewBufferString("%SIZE%\nbig\n"), p)
+	assert(t, err != nil, "expected an error for a non-numeric size")
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,175 @@
+// Package pkgfile reads package files made by makepkg
+// (.pkg.tar.zst, .pkg.tar.xz, .pkg.tar.gz and so on).
+package pkgfile
+
+import (
+	"archive/tar"
+	"bufio"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ptar "github.com/ginabythebay/poltroon/tar"
+	"github.com/pkg/errors"
+)
+
+// Info holds what a .PKGINFO file says about a package.
+type Info struct {
+	Name        string
+	Base        string
+	Version     string
+	Description string
+	URL         string
+	Arch        string
+	Packager    string
+	BuildDate   time.Time
+	// Size is how much space the package takes up once installed.
+	Size int64
+
+	Groups       []string
+	License      []string
+	Depends      []string
+	OptDepends   []string
+	MakeDepends  []string
+	CheckDepends []string
+	Provides     []string
+	Conflicts    []string
+	Replaces     []string
+	Backup       []string
+}
+
+// Package is a package file.
+type Package struct {
+	Path string
+	Info *Info
+	// Files lists what the package installs, sorted, with a trailing
+	// slash on directories.  Metadata such as .PKGINFO is left out.
+	Files []string
+}
+
+// Read reads the package file at name.
+func Read(name string) (*Package, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", name)
+	}
+	defer f.Close()
+	decompressed, err := ptar.Decompress(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing %s", name)
+	}
+	defer decompressed.Close()
+
+	result := &Package{Path: name}
+	r := tar.NewReader(decompressed)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", name)
+		}
+		entry := strings.TrimPrefix(h.Name, "./")
+		switch {
+		case entry == ".PKGINFO":
+			if result.Info, err = ParseInfo(r); err != nil {
+				return nil, errors.Wrapf(err, "parsing .PKGINFO in %s", name)
+			}
+		case strings.HasPrefix(entry, "."):
+			// .BUILDINFO, .MTREE, .INSTALL and the like
+		default:
+			if h.Typeflag == tar.TypeDir && !strings.HasSuffix(entry, "/") {
+				entry += "/"
+			}
+			result.Files = append(result.Files, entry)
+		}
+	}
+	if result.Info == nil {
+		return nil, errors.Errorf("%s has no .PKGINFO", name)
+	}
+	sort.Strings(result.Files)
+	return result, nil
+}
+
+// ParseInfo parses a .PKGINFO file, which is made of lines like
+//
+//	pkgname = foo
+//
+// with keys repeated for lists.  Keys we don't know about are ignored.
+func ParseInfo(r io.Reader) (*Info, error) {
+	info := &Info{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("line %d: expected key = value, got %q", line, text)
+		}
+		if err := info.set(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if info.Name == "" || info.Version == "" {
+		return nil, errors.New("missing pkgname or pkgver")
+	}
+	return info, nil
+}
+
+func (i *Info) set(key, value string) error {
+	var err error
+	switch key {
+	case "pkgname":
+		i.Name = value
+	case "pkgbase":
+		i.Base = value
+	case "pkgver":
+		i.Version = value
+	case "pkgdesc":
+		i.Description = value
+	case "url":
+		i.URL = value
+	case "arch":
+		i.Arch = value
+	case "packager":
+		i.Packager = value
+	case "builddate":
+		var secs int64
+		secs, err = strconv.ParseInt(value, 10, 64)
+		i.BuildDate = time.Unix(secs, 0).UTC()
+	case "size":
+		i.Size, err = strconv.ParseInt(value, 10, 64)
+	case "group":
+		i.Groups = append(i.Groups, value)
+	case "license":
+		i.License = append(i.License, value)
+	case "depend":
+		i.Depends = append(i.Depends, value)
+	case "optdepend":
+		i.OptDepends = append(i.OptDepends, value)
+	case "makedepend":
+		i.MakeDepends = append(i.MakeDepends, value)
+	case "checkdepend":
+		i.CheckDepends = append(i.CheckDepends, value)
+	case "provides":
+		i.Provides = append(i.Provides, value)
+	case "conflict":
+		i.Conflicts = append(i.Conflicts, value)
+	case "replaces":
+		i.Replaces = append(i.Replaces, value)
+	case "backup":
+		i.Backup = append(i.Backup, value)
+	}
+	return errors.Wrap(err, key)
+}
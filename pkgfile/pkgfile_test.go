@@ -0,0 +1,168 @@
+package pkgfile
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+const fooInfo = `# Generated by makepkg 6.0.2
+pkgname = foo
+pkgbase = foo-base
+pkgver = 1:2.0-3
+pkgdesc = A foo = a bar
+url = https://example.com/foo
+builddate = 1500000000
+packager = Someone <someone@example.com>
+size = 4096
+arch = x86_64
+license = MIT
+depend = glibc
+depend = libbar>=2
+optdepend = baz: for bazzing
+makedepend = cmake
+`
+
+// writePkg writes a gzipped package file holding a .PKGINFO and
+// entries, which are directories if they end with a slash.
+func writePkg(t *testing.T, name, pkginfo string, entries ...string) {
+	f, err := os.Create(name)
+	ok(t, err)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	w := tar.NewWriter(gz)
+	defer w.Close()
+
+	add := func(name, contents string) {
+		h := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			h.Typeflag, h.Mode, h.Size = tar.TypeDir, 0755, 0
+			contents = ""
+		}
+		ok(t, w.WriteHeader(h))
+		_, err := w.Write([]byte(contents))
+		ok(t, err)
+	}
+	add(".PKGINFO", pkginfo)
+	add(".MTREE", "mtree")
+	for _, e := range entries {
+		add(e, "contents of "+e)
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_pkgfile_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "foo-1:2.0-3-x86_64.pkg.tar.gz")
+	writePkg(t, name, fooInfo, "usr/", "usr/bin/", "usr/bin/foo", "usr/share/foo/README")
+	p, err := Read(name)
+	ok(t, err)
+	equals(t, name, p.Path)
+	equals(t, []string{"usr/", "usr/bin/", "usr/bin/foo", "usr/share/foo/README"}, p.Files)
+	equals(t, &Info{
+		Name:        "foo",
+		Base:        "foo-base",
+		Version:     "1:2.0-3",
+		Description: "A foo = a bar",
+		URL:         "https://example.com/foo",
+		Arch:        "x86_64",
+		Packager:    "Someone <someone@example.com>",
+		BuildDate:   time.Unix(1500000000, 0).UTC(),
+		Size:        4096,
+		License:     []string{"MIT"},
+		Depends:     []string{"glibc", "libbar>=2"},
+		OptDepends:  []string{"baz: for bazzing"},
+		MakeDepends: []string{"cmake"},
+	}, p.Info)
+
+	noinfo := path.Join(dir, "noinfo.pkg.tar.gz")
+	writePkg(t, noinfo, "")
+	_, err = Read(noinfo)
+	assert(t, err != nil, "expected an error for a package without a name or version")
+}
+
+func TestParseInfoErrors(t *testing.T) {
+	for _, text := range []string{
+		"pkgname foo\n",
+		"pkgname = foo\npkgver = 1-1\nsize = big\n",
+		"pkgver = 1-1\n",
+	} {
+		_, err := ParseInfo(strings.NewReader(text))
+		assert(t, err != nil, "expected an error parsing %q", text)
+	}
+}
+
+func made(name, base, version string) *Package {
+	return &Package{
+		Path: "/pkgs/" + name + "-" + version + "-any.pkg.tar.zst",
+		Info: &Info{Name: name, Base: base, Version: version},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	foo := []string{"foo"}
+	tests := []struct {
+		name     string
+		pkgs     []*Package
+		names    []string
+		base     string
+		version  string
+		expected []string
+	}{
+		{"matches", []*Package{made("foo", "", "1.0-1")}, foo, "", "1.0-1", nil},
+		{"zero epoch", []*Package{made("foo", "", "0:1.0-1")}, foo, "foo", "1.0-1", nil},
+		{"split", []*Package{made("foo", "foo-base", "1:1.0-1"), made("foo-docs", "foo-base", "1:1.0-1")},
+			[]string{"foo", "foo-docs"}, "foo-base", "1:1.0-1", nil},
+		{"unversioned", []*Package{made("foo", "", "1.0-1")}, foo, "", "", nil},
+		{"wrong version", []*Package{made("foo", "", "1.0-2")}, foo, "", "1.0-1",
+			[]string{"foo-1.0-2-any.pkg.tar.zst is version 1.0-2, not 1.0-1"}},
+		{"stranger", []*Package{made("foo", "", "1.0-1"), made("bar", "", "1.0-1")}, foo, "foo", "1.0-1",
+			[]string{"bar-1.0-1-any.pkg.tar.zst is from package base bar, not foo"}},
+		{"missing", []*Package{made("foo-docs", "foo", "1.0-1")}, []string{"foo", "foo-extras"}, "foo", "1.0-1",
+			[]string{"no package named foo was made", "no package named foo-extras was made"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			equals(t, test.expected, Check(test.pkgs, test.names, test.base, test.version))
+		})
+	}
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
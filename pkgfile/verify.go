@@ -0,0 +1,53 @@
+package pkgfile
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/ginabythebay/alpm"
+)
+
+// Check compares packages made from one package base against what we
+// expected to make, returning a description of each difference.
+// Every one of names must have been made.  Split packages may have
+// other names, but must come from the same package base.  An empty
+// base or version isn't checked.
+func Check(pkgs []*Package, names []string, base, version string) []string {
+	var result []string
+	found := map[string]bool{}
+	for _, p := range pkgs {
+		info := p.Info
+		file := path.Base(p.Path)
+		found[info.Name] = true
+		pkgbase := info.Base
+		if pkgbase == "" {
+			pkgbase = info.Name
+		}
+		if base != "" && pkgbase != base {
+			result = append(result, fmt.Sprintf("%s is from package base %s, not %s", file, pkgbase, base))
+		}
+		// VerCmp, so that an epoch of 0 is the same as none at all.
+		if version != "" && alpm.VerCmp(info.Version, version) != 0 {
+			result = append(result, fmt.Sprintf("%s is version %s, not %s", file, info.Version, version))
+		}
+	}
+	for _, n := range names {
+		if !found[n] {
+			result = append(result, fmt.Sprintf("no package named %s was made", n))
+		}
+	}
+	return result
+}
+
+// ReadAll reads each of the package files at paths.
+func ReadAll(paths []string) ([]*Package, error) {
+	var result []*Package
+	for _, p := range paths {
+		pkg, err := Read(p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pkg)
+	}
+	return result, nil
+}
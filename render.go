@@ -0,0 +1,59 @@
+package poltroon
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Assume the terminal is at least 60 chars wide and that we are
+// handling less than 100 packages.
+const availableCols = 60 - len("(33/44))")
+
+// RenderText writes a progress line to w as events arrive, along with
+// a line for each make that finishes.  total is the number of packages
+// being attempted.  Returns once events is closed.
+func RenderText(w io.Writer, total int, events <-chan Event) {
+	making := map[string]bool{}
+	finished := 0
+	for e := range events {
+		switch e.Type {
+		case MakeStarted:
+			making[e.Package] = true
+		case MakeSucceeded:
+			fmt.Fprintf(w, "Made %s in %s\n", e.Package, e.Duration)
+		case MakeFailed:
+			fmt.Fprintf(w, "Failed to make %s after %s\n", e.Package, e.Duration)
+		case Limited:
+			if making[e.Package] {
+				fmt.Fprintf(w, "Stopped making %s after %s: %v\n", e.Package, e.Duration, e.Err)
+			}
+		}
+		if e.Type.Final() {
+			delete(making, e.Package)
+			finished++
+		}
+		if e.Type != FetchStarted && finished != total {
+			fmt.Fprint(w, progress(finished, total, making)+"\r")
+		}
+	}
+}
+
+func progress(finished, total int, beingMade map[string]bool) string {
+	making := make([]string, 0, len(beingMade))
+	for key := range beingMade {
+		making = append(making, key)
+	}
+	// Forcing this into a predictable order will avoid the output
+	// changing when nothing changed
+	sort.Strings(making)
+	currentlyMaking := ""
+	if len(making) > 0 {
+		currentlyMaking = fmt.Sprintf(" Making %s", strings.Join(making, ", "))
+		if len(currentlyMaking) > availableCols {
+			currentlyMaking = fmt.Sprintf(" Making %d packages", len(making))
+		}
+	}
+	return fmt.Sprintf("(%d/%d)%s", finished, total, currentlyMaking)
+}
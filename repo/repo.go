@@ -0,0 +1,336 @@
+// Package repo maintains a local pacman repository: a directory of
+// package files along with the databases that pacman -Sy downloads,
+// the way repo-add does.
+package repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ginabythebay/poltroon/pacdb"
+	"github.com/ginabythebay/poltroon/pkgfile"
+	ptar "github.com/ginabythebay/poltroon/tar"
+	"github.com/pkg/errors"
+)
+
+// Repo is a local repository.  Point pacman at it with something like
+//
+//	[poltroon]
+//	SigLevel = Optional TrustAll
+//	Server = file:///var/cache/poltroon/repo
+type Repo struct {
+	// Dir holds the package files and databases.
+	Dir string
+	// Name is the repository name, as used in pacman.conf.
+	Name string
+}
+
+// New returns the repository called name in dir.
+func New(dir, name string) *Repo {
+	return &Repo{dir, name}
+}
+
+// DBPath returns the path of the package database.
+func (r *Repo) DBPath() string {
+	return path.Join(r.Dir, r.Name+".db.tar.gz")
+}
+
+// FilesPath returns the path of the database that also lists the
+// files in each package.
+func (r *Repo) FilesPath() string {
+	return path.Join(r.Dir, r.Name+".files.tar.gz")
+}
+
+// entry is what the databases hold for one package, in a directory
+// named name-version.
+type entry struct {
+	name     string
+	filename string
+	desc     []byte
+	files    []byte
+}
+
+// Add copies package files into the repository and adds them to its
+// databases.  Any other version of the same package is removed, from
+// the databases and from the directory.
+func (r *Repo) Add(pkgPaths ...string) error {
+	if err := os.MkdirAll(r.Dir, 0755); err != nil {
+		return errors.Wrapf(err, "creating %s", r.Dir)
+	}
+	entries, err := r.read()
+	if err != nil {
+		return err
+	}
+
+	var superseded []string
+	for _, p := range pkgPaths {
+		pkg, err := pkgfile.Read(p)
+		if err != nil {
+			return err
+		}
+		filename := path.Base(p)
+		if err = copyFile(p, path.Join(r.Dir, filename)); err != nil {
+			return err
+		}
+		sig, err := ioutil.ReadFile(p + ".sig")
+		if err == nil {
+			err = copyFile(p+".sig", path.Join(r.Dir, filename+".sig"))
+		} else if os.IsNotExist(err) {
+			sig, err = nil, nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "adding signature for %s", p)
+		}
+
+		e, err := newEntry(path.Join(r.Dir, filename), pkg, sig)
+		if err != nil {
+			return err
+		}
+		for dir, old := range entries {
+			if old.name == e.name {
+				delete(entries, dir)
+				if old.filename != filename {
+					superseded = append(superseded, old.filename)
+				}
+			}
+		}
+		entries[pkg.Info.Name+"-"+pkg.Info.Version] = e
+	}
+
+	if err = r.write(r.DBPath(), entries, false); err != nil {
+		return err
+	}
+	if err = r.write(r.FilesPath(), entries, true); err != nil {
+		return err
+	}
+	for _, f := range superseded {
+		for _, name := range []string{f, f + ".sig"} {
+			if err = os.Remove(path.Join(r.Dir, name)); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "removing superseded package")
+			}
+		}
+	}
+	return nil
+}
+
+// read returns what is in the files database, keyed by directory.  A
+// repository without one is empty.
+func (r *Repo) read() (map[string]*entry, error) {
+	result := map[string]*entry{}
+	f, err := os.Open(r.FilesPath())
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", r.FilesPath())
+	}
+	defer f.Close()
+	decompressed, err := ptar.Decompress(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decompressing %s", r.FilesPath())
+	}
+	defer decompressed.Close()
+
+	tr := tar.NewReader(decompressed)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", r.FilesPath())
+		}
+		dir, base := path.Split(h.Name)
+		dir = strings.TrimSuffix(dir, "/")
+		if dir == "" || h.Typeflag == tar.TypeDir {
+			continue
+		}
+		e, ok := result[dir]
+		if !ok {
+			e = &entry{}
+			result[dir] = e
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading %s", r.FilesPath())
+		}
+		switch base {
+		case "desc":
+			e.desc = contents
+			p, err := pacdb.ReadDesc(bytes.NewReader(contents))
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing %s in %s", h.Name, r.FilesPath())
+			}
+			e.name, e.filename = p.Name, p.Filename
+		case "files":
+			e.files = contents
+		}
+	}
+	return result, nil
+}
+
+// write writes entries as a gzipped database to name, along with the
+// symlink pacman looks for, replacing whatever was there.
+func (r *Repo) write(name string, entries map[string]*entry, withFiles bool) error {
+	dirs := make([]string, 0, len(entries))
+	for d := range entries {
+		dirs = append(dirs, d)
+	}
+	sort.Strings(dirs)
+
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "creating %s", tmp)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(h *tar.Header, contents []byte) error {
+		h.ModTime = now
+		h.Size = int64(len(contents))
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		_, err := tw.Write(contents)
+		return err
+	}
+	for _, d := range dirs {
+		e := entries[d]
+		if err = add(&tar.Header{Name: d + "/", Typeflag: tar.TypeDir, Mode: 0755}, nil); err != nil {
+			break
+		}
+		if err = add(&tar.Header{Name: d + "/desc", Typeflag: tar.TypeReg, Mode: 0644}, e.desc); err != nil {
+			break
+		}
+		if withFiles {
+			if err = add(&tar.Header{Name: d + "/files", Typeflag: tar.TypeReg, Mode: 0644}, e.files); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return errors.Wrapf(err, "writing %s", tmp)
+	}
+	if err = os.Rename(tmp, name); err != nil {
+		return errors.Wrapf(err, "renaming %s", tmp)
+	}
+
+	// pacman downloads name.db and name.files.
+	link := strings.TrimSuffix(name, ".tar.gz")
+	if err = os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "replacing %s", link)
+	}
+	return errors.Wrapf(os.Symlink(path.Base(name), link), "linking %s", link)
+}
+
+// newEntry makes the database entry for pkg, whose file is at
+// filePath.
+func newEntry(filePath string, pkg *pkgfile.Package, sig []byte) (*entry, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", filePath)
+	}
+	defer f.Close()
+	md5sum, sha256sum := md5.New(), sha256.New()
+	size, err := io.Copy(io.MultiWriter(md5sum, sha256sum), f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", filePath)
+	}
+
+	info := pkg.Info
+	var buf bytes.Buffer
+	section := func(key string, values ...string) {
+		if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+			return
+		}
+		fmt.Fprintf(&buf, "%%%s%%\n%s\n\n", key, strings.Join(values, "\n"))
+	}
+	section("FILENAME", path.Base(filePath))
+	section("NAME", info.Name)
+	section("BASE", info.Base)
+	section("VERSION", info.Version)
+	section("DESC", info.Description)
+	section("GROUPS", info.Groups...)
+	section("CSIZE", fmt.Sprint(size))
+	section("ISIZE", fmt.Sprint(info.Size))
+	section("MD5SUM", hex.EncodeToString(md5sum.Sum(nil)))
+	section("SHA256SUM", hex.EncodeToString(sha256sum.Sum(nil)))
+	if sig != nil {
+		section("PGPSIG", base64.StdEncoding.EncodeToString(sig))
+	}
+	section("URL", info.URL)
+	section("LICENSE", info.License...)
+	section("ARCH", info.Arch)
+	section("BUILDDATE", fmt.Sprint(info.BuildDate.Unix()))
+	section("PACKAGER", info.Packager)
+	section("REPLACES", info.Replaces...)
+	section("CONFLICTS", info.Conflicts...)
+	section("PROVIDES", info.Provides...)
+	section("DEPENDS", info.Depends...)
+	section("OPTDEPENDS", info.OptDepends...)
+	section("MAKEDEPENDS", info.MakeDepends...)
+	section("CHECKDEPENDS", info.CheckDepends...)
+
+	files := "%FILES%\n" + strings.Join(pkg.Files, "\n") + "\n"
+	return &entry{
+		name:     info.Name,
+		filename: path.Base(filePath),
+		desc:     buf.Bytes(),
+		files:    []byte(files),
+	}, nil
+}
+
+// copyFile copies src to dst, unless they are the same file.
+func copyFile(src, dst string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrapf(err, "copying %s", src)
+	}
+	if dstInfo, err := os.Stat(dst); err == nil && os.SameFile(srcInfo, dstInfo) {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "copying %s", src)
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "copying %s", src)
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	return errors.Wrapf(err, "copying %s", src)
+}
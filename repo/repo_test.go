@@ -0,0 +1,141 @@
+package repo
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ginabythebay/poltroon/pacdb"
+)
+
+// writePkg writes a gzipped package file for name and version into
+// dir, holding a single file, and returns its path.
+func writePkg(t *testing.T, dir, name, version string) string {
+	p := path.Join(dir, fmt.Sprintf("%s-%s-any.pkg.tar.gz", name, version))
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	add := func(name, contents string) {
+		ok(t, w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}))
+		_, err := w.Write([]byte(contents))
+		ok(t, err)
+	}
+	add(".PKGINFO", fmt.Sprintf("pkgname = %s\npkgver = %s\narch = any\nsize = 10\ndepend = glibc\n", name, version))
+	add("usr/bin/"+name, "#!/bin/sh\n")
+	ok(t, w.Close())
+	ok(t, gz.Close())
+	ok(t, ioutil.WriteFile(p, buf.Bytes(), 0644))
+	return p
+}
+
+// dbContents returns the names of the entries in a gzipped database,
+// and the contents of the regular files.
+func dbContents(t *testing.T, name string) map[string]string {
+	f, err := os.Open(name)
+	ok(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	ok(t, err)
+	r := tar.NewReader(gz)
+	result := map[string]string{}
+	for {
+		h, err := r.Next()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(r)
+		ok(t, err)
+		result[h.Name] = string(b)
+	}
+	return result
+}
+
+func TestAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_repo_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	built := path.Join(dir, "built")
+	ok(t, os.Mkdir(built, 0755))
+
+	r := New(path.Join(dir, "repo"), "poltroon")
+	ok(t, r.Add(writePkg(t, built, "foo", "1-1"), writePkg(t, built, "bar", "1.0-1")))
+
+	newFoo := writePkg(t, built, "foo", "1:2-1")
+	ok(t, ioutil.WriteFile(newFoo+".sig", []byte("signature"), 0644))
+	ok(t, r.Add(newFoo))
+
+	files, err := filepath.Glob(path.Join(r.Dir, "*"))
+	ok(t, err)
+	for i := range files {
+		files[i] = path.Base(files[i])
+	}
+	equals(t, []string{
+		"bar-1.0-1-any.pkg.tar.gz",
+		"foo-1:2-1-any.pkg.tar.gz",
+		"foo-1:2-1-any.pkg.tar.gz.sig",
+		"poltroon.db",
+		"poltroon.db.tar.gz",
+		"poltroon.files",
+		"poltroon.files.tar.gz",
+	}, files)
+
+	db := dbContents(t, r.DBPath())
+	_, found := db["foo-1-1/desc"]
+	assert(t, !found, "expected the old foo to be gone")
+	_, found = db["foo-1:2-1/files"]
+	assert(t, !found, "expected no files list in the package database")
+	desc := db["foo-1:2-1/desc"]
+	for _, s := range []string{"%FILENAME%\nfoo-1:2-1-any.pkg.tar.gz\n", "%PGPSIG%\nc2lnbmF0dXJl\n", "%DEPENDS%\nglibc\n", "%SHA256SUM%\n"} {
+		assert(t, strings.Contains(desc, s), "expected %q in %q", s, desc)
+	}
+	equals(t, "%FILES%\nusr/bin/foo\n", dbContents(t, r.FilesPath())["foo-1:2-1/files"])
+
+	// pacman can read what we wrote.
+	dbPath := path.Join(dir, "pacman")
+	ok(t, os.MkdirAll(path.Join(dbPath, "sync"), 0755))
+	ok(t, os.Symlink(path.Join(r.Dir, "poltroon.db"), path.Join(dbPath, "sync", "poltroon.db")))
+	sync, err := pacdb.New(dbPath).Sync()
+	ok(t, err)
+	pkgs := sync["poltroon"]
+	equals(t, 2, len(pkgs))
+	equals(t, "bar", pkgs[0].Name)
+	equals(t, "foo", pkgs[1].Name)
+	equals(t, "1:2-1", pkgs[1].Version)
+	equals(t, int64(10), pkgs[1].Size)
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
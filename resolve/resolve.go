@@ -0,0 +1,305 @@
+// Package resolve expands a set of AUR packages into a build plan
+// that includes every AUR-only package they depend on.
+package resolve
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/aur"
+	"github.com/pkg/errors"
+)
+
+// InfoGetter fetches package information from the AUR.  *aur.Client
+// implements this.
+type InfoGetter interface {
+	GetInfos(ctx context.Context, names []string) (map[string]*aur.PkgInfo, error)
+}
+
+// Satisfier reports which dependencies can be satisfied without the
+// AUR, either because they are already installed or because a sync
+// repository provides them.  Dependencies are in pacman form,
+// e.g. "foo>=1.2".  The returned map holds an entry for every
+// satisfiable dependency.
+type Satisfier interface {
+	Satisfied(deps []string) (map[string]bool, error)
+}
+
+// Resolver expands packages into build plans.
+type Resolver struct {
+	// Infos is used to look up dependencies in the AUR.
+	Infos InfoGetter
+	// Repo decides which dependencies don't need to be built.
+	Repo Satisfier
+	// Root is passed to poltroon.NewAurPackage for packages we discover.
+	Root string
+}
+
+// Plan is the result of resolving a set of packages.
+type Plan struct {
+	// Packages holds everything we need to build, with every package
+	// after all of its AurDepends.
+	Packages []*poltroon.AurPackage
+	// RepoDeps holds dependencies that will be satisfied from
+	// installed packages or the sync repositories, sorted.
+	RepoDeps []string
+	// Missing holds dependencies that could be found neither in the
+	// repositories nor in the AUR, sorted.
+	Missing []string
+}
+
+// CycleError is returned when AUR packages depend on each other in a
+// loop, so there is no order we can build them in.
+type CycleError struct {
+	// Cycle holds the package names in the loop, with the first name
+	// repeated at the end.
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// Resolve expands targets with every AUR package needed to build
+// them.  Depends, MakeDepends and CheckDepends are all considered.
+// Each target gets its AurDepends set.  Version constraints are
+// passed through to Repo but otherwise ignored, and AUR packages are
+// only matched by name, not by what they provide.  A dependency from
+// the same package base as a package already in the plan becomes one
+// of its Members rather than a package of its own.
+func (r *Resolver) Resolve(ctx context.Context, targets []*poltroon.AurPackage) (*Plan, error) {
+	// Members map to the package they are made with.
+	byName := map[string]*poltroon.AurPackage{}
+	byBase := map[string]*poltroon.AurPackage{}
+	order := []string{}
+	for _, t := range targets {
+		t.AurDepends = nil
+		for _, n := range t.Wanted() {
+			byName[n] = t
+		}
+		byBase[t.Base()] = t
+		order = append(order, t.Name)
+	}
+
+	repoDeps := map[string]bool{}
+	missing := map[string]bool{}
+	// Everything we asked the AUR about, with nil for names it
+	// doesn't have, so that nothing is asked about twice.
+	infos := map[string]*aur.PkgInfo{}
+
+	pending := targets
+	for len(pending) > 0 {
+		names := make([]string, 0, len(pending))
+		for _, p := range pending {
+			names = append(names, p.Wanted()...)
+		}
+		if err := r.getInfos(ctx, infos, names); err != nil {
+			return nil, errors.Wrap(err, "resolve get infos")
+		}
+
+		// dependency string -> packages needing it, for things not
+		// already known to be in the plan or in a repository.
+		unknown := map[string][]*poltroon.AurPackage{}
+		var unknownOrder []string
+		for _, p := range pending {
+			var deps []string
+			for _, n := range p.Wanted() {
+				info := infos[n]
+				if info == nil {
+					missing[n] = true
+					continue
+				}
+				deps = append(deps, allDepends(info)...)
+			}
+			for _, dep := range deps {
+				name := depName(dep)
+				if known, ok := byName[name]; ok {
+					addDepend(p, known.Name)
+					continue
+				}
+				if repoDeps[dep] || missing[name] {
+					continue
+				}
+				if _, ok := unknown[dep]; !ok {
+					unknownOrder = append(unknownOrder, dep)
+				}
+				unknown[dep] = append(unknown[dep], p)
+			}
+		}
+
+		pending = nil
+		if len(unknownOrder) == 0 {
+			break
+		}
+		satisfied, err := r.Repo.Satisfied(unknownOrder)
+		if err != nil {
+			return nil, errors.Wrap(err, "resolve check repositories")
+		}
+		var aurNames []string
+		for _, dep := range unknownOrder {
+			if satisfied[dep] {
+				repoDeps[dep] = true
+				continue
+			}
+			aurNames = append(aurNames, depName(dep))
+		}
+		if len(aurNames) == 0 {
+			continue
+		}
+		if err = r.getInfos(ctx, infos, aurNames); err != nil {
+			return nil, errors.Wrap(err, "resolve get dependency infos")
+		}
+		for _, dep := range unknownOrder {
+			if satisfied[dep] {
+				continue
+			}
+			name := depName(dep)
+			pkg, ok := byName[name]
+			if !ok {
+				info := infos[name]
+				if info == nil {
+					missing[name] = true
+					continue
+				}
+				if sibling, ok := byBase[info.PackageBase]; ok && info.PackageBase != "" {
+					// Made along with sibling, which we look at again
+					// for what the new member depends on.
+					pkg = sibling
+					pkg.Members = append(pkg.Members, name)
+				} else {
+					pkg = poltroon.NewAurPackage(r.Root, info.Name, "", info.Version, info.SnapshotURL)
+					pkg.PackageBase = info.PackageBase
+					pkg.Dependency = true
+					byBase[pkg.Base()] = pkg
+					order = append(order, name)
+				}
+				byName[name] = pkg
+				pending = append(pending, pkg)
+			}
+			for _, needer := range unknown[dep] {
+				addDepend(needer, pkg.Name)
+			}
+		}
+	}
+
+	sorted, err := topoSort(order, byName)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Packages: sorted,
+		RepoDeps: sortedKeys(repoDeps),
+		Missing:  sortedKeys(missing),
+	}, nil
+}
+
+// getInfos adds what the AUR has on names to infos, only asking about
+// the ones not already in it.
+func (r *Resolver) getInfos(ctx context.Context, infos map[string]*aur.PkgInfo, names []string) error {
+	var unknown []string
+	for _, n := range names {
+		if _, ok := infos[n]; !ok {
+			unknown = append(unknown, n)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	found, err := r.Infos.GetInfos(ctx, unknown)
+	if err != nil {
+		return err
+	}
+	for _, n := range unknown {
+		infos[n] = found[n]
+	}
+	return nil
+}
+
+// topoSort returns the packages so that every package comes after
+// its AurDepends.  Ties are broken by the order in names.
+func topoSort(names []string, byName map[string]*poltroon.AurPackage) ([]*poltroon.AurPackage, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	result := make([]*poltroon.AurPackage, 0, len(names))
+	var stack []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for i, s := range stack {
+				if s == name {
+					start = i
+				}
+			}
+			cycle := append(append([]string{}, stack[start:]...), name)
+			return &CycleError{cycle}
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		pkg := byName[name]
+		for _, d := range pkg.AurDepends {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		result = append(result, pkg)
+		return nil
+	}
+
+	for _, n := range names {
+		if err := visit(n); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func allDepends(info *aur.PkgInfo) []string {
+	var result []string
+	result = append(result, info.Depends...)
+	result = append(result, info.MakeDepends...)
+	result = append(result, info.CheckDepends...)
+	return result
+}
+
+// depName strips any version constraint from a dependency,
+// e.g. "foo>=1.2" becomes "foo".
+func depName(dep string) string {
+	if i := strings.IndexAny(dep, "<>="); i != -1 {
+		return dep[:i]
+	}
+	return dep
+}
+
+func addDepend(pkg *poltroon.AurPackage, name string) {
+	if name == pkg.Name {
+		return
+	}
+	for _, d := range pkg.AurDepends {
+		if d == name {
+			return
+		}
+	}
+	pkg.AurDepends = append(pkg.AurDepends, name)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
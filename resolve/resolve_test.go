@@ -0,0 +1,200 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ginabythebay/poltroon"
+	"github.com/ginabythebay/poltroon/aur"
+)
+
+type fakeAur map[string]*aur.PkgInfo
+
+func (f fakeAur) GetInfos(ctx context.Context, names []string) (map[string]*aur.PkgInfo, error) {
+	result := map[string]*aur.PkgInfo{}
+	for _, n := range names {
+		if info, ok := f[n]; ok {
+			result[n] = info
+		}
+	}
+	return result, nil
+}
+
+type fakeRepo map[string]bool
+
+func (f fakeRepo) Satisfied(deps []string) (map[string]bool, error) {
+	result := map[string]bool{}
+	for _, d := range deps {
+		if f[depName(d)] {
+			result[d] = true
+		}
+	}
+	return result, nil
+}
+
+func info(name string, depends, makeDepends []string) *aur.PkgInfo {
+	return &aur.PkgInfo{
+		Name:        name,
+		Version:     "1-1",
+		SnapshotURL: "/" + name + ".tar.gz",
+		Depends:     depends,
+		MakeDepends: makeDepends,
+	}
+}
+
+func names(pkgs []*poltroon.AurPackage) []string {
+	result := []string{}
+	for _, p := range pkgs {
+		result = append(result, p.Name)
+	}
+	return result
+}
+
+func TestResolve(t *testing.T) {
+	infos := fakeAur{
+		"foo":    info("foo", []string{"glibc", "libbar>=2"}, []string{"cmake", "libbaz"}),
+		"libbar": info("libbar", []string{"libqux"}, nil),
+		"libbaz": info("libbaz", []string{"libqux", "nowhere"}, nil),
+		"libqux": info("libqux", []string{"glibc"}, nil),
+	}
+	r := &Resolver{infos, fakeRepo{"glibc": true, "cmake": true}, "/root"}
+	foo := poltroon.NewAurPackage("/root", "foo", "", "1-1", "/foo.tar.gz")
+
+	plan, err := r.Resolve(context.Background(), []*poltroon.AurPackage{foo})
+	ok(t, err)
+	equals(t, []string{"libqux", "libbar", "libbaz", "foo"}, names(plan.Packages))
+	equals(t, []string{"cmake", "glibc"}, plan.RepoDeps)
+	equals(t, []string{"nowhere"}, plan.Missing)
+	equals(t, []string{"libbar", "libbaz"}, foo.AurDepends)
+	equals(t, "/root/libqux/1-1", plan.Packages[0].Root)
+	assert(t, plan.Packages[0].Dependency, "libqux should be marked as a dependency")
+	assert(t, !foo.Dependency, "foo should not be marked as a dependency")
+}
+
+func TestResolveBetweenTargets(t *testing.T) {
+	infos := fakeAur{
+		"a": info("a", []string{"b"}, nil),
+		"b": info("b", nil, nil),
+	}
+	// b is installed, but it is also being updated, so it needs to
+	// be built first.
+	r := &Resolver{infos, fakeRepo{"b": true}, "/root"}
+	a := poltroon.NewAurPackage("/root", "a", "0-1", "1-1", "")
+	b := poltroon.NewAurPackage("/root", "b", "0-1", "1-1", "")
+
+	plan, err := r.Resolve(context.Background(), []*poltroon.AurPackage{a, b})
+	ok(t, err)
+	equals(t, []string{"b", "a"}, names(plan.Packages))
+	equals(t, []string{}, plan.RepoDeps)
+}
+
+func TestResolveCycle(t *testing.T) {
+	infos := fakeAur{
+		"a": info("a", []string{"b"}, nil),
+		"b": info("b", []string{"c"}, nil),
+		"c": info("c", nil, []string{"a"}),
+	}
+	r := &Resolver{infos, fakeRepo{}, "/root"}
+	a := poltroon.NewAurPackage("/root", "a", "", "1-1", "")
+
+	_, err := r.Resolve(context.Background(), []*poltroon.AurPackage{a})
+	cycle, isCycle := err.(*CycleError)
+	assert(t, isCycle, "expected a CycleError, got %v", err)
+	equals(t, []string{"a", "b", "c", "a"}, cycle.Cycle)
+}
+
+func TestResolveSplit(t *testing.T) {
+	split := func(name string, depends ...string) *aur.PkgInfo {
+		i := info(name, depends, nil)
+		i.PackageBase = "libs"
+		return i
+	}
+	infos := fakeAur{
+		"foo":    info("foo", []string{"libfoo", "libbar"}, nil),
+		"libfoo": split("libfoo"),
+		"libbar": split("libbar", "libfoo", "libqux"),
+		"libqux": info("libqux", nil, nil),
+	}
+	r := &Resolver{infos, fakeRepo{}, "/root"}
+	foo := poltroon.NewAurPackage("/root", "foo", "", "1-1", "")
+
+	plan, err := r.Resolve(context.Background(), []*poltroon.AurPackage{foo})
+	ok(t, err)
+	equals(t, []string{"libqux", "libfoo", "foo"}, names(plan.Packages))
+	equals(t, []string{"libbar"}, plan.Packages[1].Members)
+	equals(t, []string{"libqux"}, plan.Packages[1].AurDepends)
+	equals(t, []string{"libfoo"}, foo.AurDepends)
+}
+
+// Each package is only asked about once, so a chain of dependencies
+// takes one request for the targets and one per level.
+func TestResolveRequests(t *testing.T) {
+	infos := fakeAur{
+		"foo":    info("foo", []string{"libbar", "gone"}, nil),
+		"libbar": info("libbar", []string{"libqux"}, nil),
+		"libqux": info("libqux", nil, nil),
+	}
+	var requested [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		args := r.URL.Query()["arg[]"]
+		requested = append(requested, args)
+		results := []map[string]interface{}{}
+		for _, n := range args {
+			if i, ok := infos[n]; ok {
+				results = append(results, map[string]interface{}{"Name": i.Name, "Version": i.Version, "Depends": i.Depends})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"type": "multiinfo", "resultcount": len(results), "results": results})
+	}))
+	defer server.Close()
+
+	r := &Resolver{aur.NewClient(server.URL, time.Minute), fakeRepo{}, "/root"}
+	foo := poltroon.NewAurPackage("/root", "foo", "", "1-1", "")
+	plan, err := r.Resolve(context.Background(), []*poltroon.AurPackage{foo})
+	ok(t, err)
+	equals(t, []string{"libqux", "libbar", "foo"}, names(plan.Packages))
+	equals(t, []string{"gone"}, plan.Missing)
+	equals(t, [][]string{{"foo"}, {"libbar", "gone"}, {"libqux"}}, requested)
+}
+
+func TestDepName(t *testing.T) {
+	equals(t, "foo", depName("foo"))
+	equals(t, "foo", depName("foo>=1.2"))
+	equals(t, "foo", depName("foo=1"))
+	equals(t, "foo", depName("foo<2"))
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
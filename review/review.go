@@ -0,0 +1,135 @@
+// Package review keeps copies of the package files a user has
+// approved, so that the next time a package is built we can show just
+// what changed.
+package review
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Store holds the last approved snapshot of each package, in a
+// sub-directory named after the package.
+type Store struct {
+	Dir string
+}
+
+// NewStore returns a Store that keeps snapshots in dir.
+func NewStore(dir string) *Store {
+	return &Store{dir}
+}
+
+// Path returns where the snapshot for the named package is kept.
+func (s *Store) Path(name string) string {
+	return path.Join(s.Dir, name)
+}
+
+// Has returns true if there is a snapshot for the named package.
+func (s *Store) Has(name string) bool {
+	_, err := os.Stat(s.Path(name))
+	return err == nil
+}
+
+// Diff returns a unified diff from the stored snapshot of the named
+// package to the files in dir.  If there is no stored snapshot, every
+// file in dir shows up as added.  File names in the diff are
+// relative, prefixed with a/ and b/ as git does.  Runs the diff
+// command.
+func (s *Store) Diff(name, dir string) ([]byte, error) {
+	old := s.Path(name)
+	if !s.Has(name) {
+		empty, err := ioutil.TempDir("", "poltroon_review")
+		if err != nil {
+			return nil, errors.Wrap(err, "making empty dir to diff against")
+		}
+		defer os.RemoveAll(empty)
+		old = empty
+	}
+
+	cmd := exec.Command("diff", "--unified", "--recursive", "--new-file", old, dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil && !differencesFound(err) {
+		return nil, errors.Wrapf(err, "diffing %s: %s", name, bytes.TrimSpace(stderr.Bytes()))
+	}
+	out = bytes.Replace(out, []byte(old+"/"), []byte("a/"), -1)
+	out = bytes.Replace(out, []byte(dir+"/"), []byte("b/"), -1)
+	return out, nil
+}
+
+// diff exits with 1 when there are differences and 2 when there is
+// trouble.
+func differencesFound(err error) bool {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return false
+	}
+	waitStatus, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && waitStatus.ExitStatus() == 1
+}
+
+// Save replaces the stored snapshot for the named package with a copy
+// of dir.
+func (s *Store) Save(name, dir string) error {
+	dest := s.Path(name)
+	if err := os.RemoveAll(dest); err != nil {
+		return errors.Wrapf(err, "removing old snapshot of %s", name)
+	}
+	return Copy(dir, dest)
+}
+
+// Copy copies the regular files, directories and symlinks under src
+// to dst.  Symlinks are copied as they are, not followed.  Anything
+// else is skipped.
+func Copy(src, dst string) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, src), "/")
+		target := path.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			return copyFile(p, target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm os.FileMode) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
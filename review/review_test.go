@@ -0,0 +1,119 @@
+package review
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, contents := range files {
+		p := path.Join(root, name)
+		ok(t, os.MkdirAll(path.Dir(p), 0755))
+		ok(t, ioutil.WriteFile(p, []byte(contents), 0644))
+	}
+}
+
+func TestStore(t *testing.T) {
+	if _, err := exec.LookPath("diff"); err != nil {
+		t.Skip("diff not available")
+	}
+	workarea, err := ioutil.TempDir("", "poltroon_review_test")
+	ok(t, err)
+	defer os.RemoveAll(workarea)
+	store := NewStore(path.Join(workarea, "store"))
+
+	first := path.Join(workarea, "first")
+	writeTree(t, first, map[string]string{
+		"PKGBUILD":    "pkgname=foo\npkgver=1\n",
+		"foo.install": "post_install() { :; }\n",
+	})
+	assert(t, !store.Has("foo"), "expected no snapshot yet")
+	diff, err := store.Diff("foo", first)
+	ok(t, err)
+	assert(t, strings.Contains(string(diff), "+pkgname=foo"), "expected new file contents, got %s", diff)
+	assert(t, strings.Contains(string(diff), "b/foo.install"), "expected relative names, got %s", diff)
+	assert(t, !strings.Contains(string(diff), workarea), "expected no absolute paths, got %s", diff)
+
+	ok(t, store.Save("foo", first))
+	assert(t, store.Has("foo"), "expected a snapshot")
+	diff, err = store.Diff("foo", first)
+	ok(t, err)
+	equals(t, "", string(diff))
+
+	second := path.Join(workarea, "second")
+	writeTree(t, second, map[string]string{
+		"PKGBUILD":          "pkgname=foo\npkgver=2\n",
+		"foo.install":       "post_install() { :; }\n",
+		"patches/fix.patch": "--- a\n+++ b\n",
+	})
+	diff, err = store.Diff("foo", second)
+	ok(t, err)
+	s := string(diff)
+	assert(t, strings.Contains(s, "-pkgver=1\n+pkgver=2\n"), "expected version change, got %s", s)
+	assert(t, strings.Contains(s, "b/patches/fix.patch"), "expected new patch, got %s", s)
+	assert(t, !strings.Contains(s, "foo.install"), "expected unchanged file to be left out, got %s", s)
+}
+
+func TestCopySymlinks(t *testing.T) {
+	workarea, err := ioutil.TempDir("", "poltroon_review_test")
+	ok(t, err)
+	defer os.RemoveAll(workarea)
+
+	src := path.Join(workarea, "src")
+	writeTree(t, src, map[string]string{"patches/fix.patch": "--- a\n+++ b\n"})
+	ok(t, os.Symlink("patches/fix.patch", path.Join(src, "link.patch")))
+	ok(t, os.Symlink("missing", path.Join(src, "dangling")))
+
+	dst := path.Join(workarea, "dst")
+	ok(t, Copy(src, dst))
+	for name, want := range map[string]string{"link.patch": "patches/fix.patch", "dangling": "missing"} {
+		link, err := os.Readlink(path.Join(dst, name))
+		ok(t, err)
+		equals(t, want, link)
+	}
+
+	if _, err := exec.LookPath("diff"); err != nil {
+		return
+	}
+	store := NewStore(path.Join(workarea, "store"))
+	ok(t, os.Remove(path.Join(src, "dangling")))
+	ok(t, store.Save("foo", src))
+	diff, err := store.Diff("foo", src)
+	ok(t, err)
+	equals(t, "", string(diff))
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
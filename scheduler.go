@@ -0,0 +1,227 @@
+package poltroon
+
+import (
+	"sync"
+)
+
+// Scheduler decides when a fetched package may be made.  A package
+// is released only after every package in its AurDepends has been
+// made successfully.  When a package fails, everything that depends
+// on it, directly or not, is skipped.  Packages with no relationship
+// to each other are released as soon as they are fetched, so they
+// can be made in parallel.
+type Scheduler struct {
+	ready chan *AurPackage
+
+	// OnSkip, if set, is called once for each skipped package, with
+	// the name of the failed package that caused it.  It is called
+	// without any locks held.
+	OnSkip func(pkg *AurPackage, failed string)
+
+	mu         sync.Mutex // protects this group
+	pkgs       map[string]*AurPackage
+	state      map[string]schedState
+	fetched    map[string]bool
+	dependents map[string][]string // reverse of AurDepends
+	skipped    map[string]string   // skipped package -> failed package
+	cancelled  map[string]bool
+	remaining  int // packages not yet in a terminal state
+}
+
+type schedState int
+
+const (
+	schedWaiting schedState = iota
+	schedReleased
+	schedStarted
+	schedSucceeded
+	schedFailed
+	schedSkipped
+	schedCancelled
+)
+
+// NewScheduler creates a Scheduler for pkgs.  Dependencies on
+// packages not in pkgs are assumed to be satisfied already.
+func NewScheduler(pkgs []*AurPackage) *Scheduler {
+	s := &Scheduler{
+		ready:      make(chan *AurPackage, len(pkgs)),
+		pkgs:       map[string]*AurPackage{},
+		state:      map[string]schedState{},
+		fetched:    map[string]bool{},
+		dependents: map[string][]string{},
+		skipped:    map[string]string{},
+		cancelled:  map[string]bool{},
+		remaining:  len(pkgs),
+	}
+	for _, p := range pkgs {
+		s.pkgs[p.Name] = p
+	}
+	for _, p := range pkgs {
+		for _, d := range p.AurDepends {
+			if _, ok := s.pkgs[d]; ok {
+				s.dependents[d] = append(s.dependents[d], p.Name)
+			}
+		}
+	}
+	if s.remaining == 0 {
+		close(s.ready)
+	}
+	return s
+}
+
+// Ready delivers packages that can be made now.  It is closed once
+// every package has succeeded, failed or been skipped.
+func (s *Scheduler) Ready() <-chan *AurPackage {
+	return s.ready
+}
+
+// Fetched records that pkg has been downloaded, releasing it if its
+// dependencies are already made.  Does nothing if pkg was skipped.
+func (s *Scheduler) Fetched(pkg *AurPackage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetched[pkg.Name] = true
+	s.releaseIfReady(pkg.Name)
+}
+
+// Start records that a maker took pkg from Ready and is about to make
+// it.  Returns false if pkg was cancelled in the meantime, in which
+// case it must not be made.
+func (s *Scheduler) Start(pkg *AurPackage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state[pkg.Name] != schedReleased {
+		return false
+	}
+	s.state[pkg.Name] = schedStarted
+	return true
+}
+
+// Succeeded records that pkg was made, releasing any dependents that
+// are now ready.
+func (s *Scheduler) Succeeded(pkg *AurPackage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finish(pkg.Name, schedSucceeded)
+	for _, d := range s.dependents[pkg.Name] {
+		s.releaseIfReady(d)
+	}
+}
+
+// Failed records that pkg could not be fetched or made, and skips
+// everything that depends on it.  Returns false if pkg had already
+// been skipped or cancelled, in which case the failure has already
+// been accounted for and the caller should not report it.
+func (s *Scheduler) Failed(pkg *AurPackage) bool {
+	s.mu.Lock()
+	if st := s.state[pkg.Name]; st == schedSkipped || st == schedCancelled {
+		s.mu.Unlock()
+		return false
+	}
+	s.finish(pkg.Name, schedFailed)
+	var skipped []*AurPackage
+	s.skipDependents(pkg.Name, pkg.Name, &skipped)
+	s.mu.Unlock()
+
+	if s.OnSkip != nil {
+		for _, p := range skipped {
+			s.OnSkip(p, pkg.Name)
+		}
+	}
+	return true
+}
+
+// Cancel stops releasing packages.  Every package that hasn't been
+// started yet, whether or not it was released, is cancelled and
+// returned.  Packages already started are left to finish.
+func (s *Scheduler) Cancel() []*AurPackage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []*AurPackage
+	for name, p := range s.pkgs {
+		if st := s.state[name]; st == schedWaiting || st == schedReleased {
+			s.cancelled[name] = true
+			s.finish(name, schedCancelled)
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// Interrupted records that a started package was stopped before it
+// could finish.  Nothing else will be released after it.
+func (s *Scheduler) Interrupted(pkg *AurPackage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancelled[pkg.Name] = true
+	s.finish(pkg.Name, schedCancelled)
+}
+
+// Cancelled returns the names of packages that were cancelled before
+// being released or interrupted afterwards.
+func (s *Scheduler) Cancelled() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]bool, len(s.cancelled))
+	for k, v := range s.cancelled {
+		result[k] = v
+	}
+	return result
+}
+
+// HasDependents returns true if some other scheduled package depends
+// on pkg.
+func (s *Scheduler) HasDependents(pkg *AurPackage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.dependents[pkg.Name]) > 0
+}
+
+// Skipped returns a map from the name of each skipped package to the
+// name of the failed package that caused it to be skipped.
+func (s *Scheduler) Skipped() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make(map[string]string, len(s.skipped))
+	for k, v := range s.skipped {
+		result[k] = v
+	}
+	return result
+}
+
+// Assumes the caller holds a lock.
+func (s *Scheduler) skipDependents(name, failed string, skipped *[]*AurPackage) {
+	for _, d := range s.dependents[name] {
+		if s.state[d] != schedWaiting {
+			continue
+		}
+		s.skipped[d] = failed
+		s.finish(d, schedSkipped)
+		*skipped = append(*skipped, s.pkgs[d])
+		s.skipDependents(d, failed, skipped)
+	}
+}
+
+// Assumes the caller holds a lock.
+func (s *Scheduler) releaseIfReady(name string) {
+	if s.state[name] != schedWaiting || !s.fetched[name] {
+		return
+	}
+	for _, d := range s.pkgs[name].AurDepends {
+		if _, ok := s.pkgs[d]; ok && s.state[d] != schedSucceeded {
+			return
+		}
+	}
+	s.state[name] = schedReleased
+	// Never blocks, the channel has room for every package.
+	s.ready <- s.pkgs[name]
+}
+
+// Assumes the caller holds a lock.
+func (s *Scheduler) finish(name string, state schedState) {
+	s.state[name] = state
+	s.remaining--
+	if s.remaining == 0 {
+		close(s.ready)
+	}
+}
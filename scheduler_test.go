@@ -0,0 +1,180 @@
+package poltroon
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func newTestPkg(name string, deps ...string) *AurPackage {
+	p := NewAurPackage("/root", name, "", "1-1", "")
+	p.AurDepends = deps
+	return p
+}
+
+// drain returns the names of everything currently ready, sorted.
+func drain(s *Scheduler) []string {
+	result := []string{}
+	for {
+		select {
+		case p, ok := <-s.Ready():
+			if !ok {
+				sort.Strings(result)
+				return result
+			}
+			result = append(result, p.Name)
+		default:
+			sort.Strings(result)
+			return result
+		}
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	lib := newTestPkg("lib")
+	app := newTestPkg("app", "lib")
+	other := newTestPkg("other")
+	s := NewScheduler([]*AurPackage{lib, app, other})
+
+	s.Fetched(app)
+	equals(t, []string{}, drain(s))
+	s.Fetched(other)
+	s.Fetched(lib)
+	equals(t, []string{"lib", "other"}, drain(s))
+
+	s.Succeeded(other)
+	equals(t, []string{}, drain(s))
+	s.Succeeded(lib)
+	equals(t, []string{"app"}, drain(s))
+	s.Succeeded(app)
+
+	_, open := <-s.Ready()
+	assert(t, !open, "expected Ready to be closed")
+}
+
+func TestSchedulerFailure(t *testing.T) {
+	lib := newTestPkg("lib")
+	mid := newTestPkg("mid", "lib")
+	app := newTestPkg("app", "mid")
+	other := newTestPkg("other")
+	s := NewScheduler([]*AurPackage{lib, mid, app, other})
+	skippedBy := map[string]string{}
+	s.OnSkip = func(p *AurPackage, failed string) {
+		skippedBy[p.Name] = failed
+	}
+
+	s.Fetched(lib)
+	s.Fetched(other)
+	equals(t, []string{"lib", "other"}, drain(s))
+	assert(t, s.HasDependents(lib), "lib should have dependents")
+	assert(t, !s.HasDependents(app), "app should not have dependents")
+
+	assert(t, s.Failed(lib), "lib failure should be reported")
+	equals(t, map[string]string{"mid": "lib", "app": "lib"}, skippedBy)
+	equals(t, skippedBy, s.Skipped())
+
+	// A fetch that finishes or fails after the package was skipped
+	// changes nothing.
+	s.Fetched(mid)
+	assert(t, !s.Failed(app), "app failure should not be reported")
+	equals(t, []string{}, drain(s))
+
+	s.Succeeded(other)
+	_, open := <-s.Ready()
+	assert(t, !open, "expected Ready to be closed")
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	lib := newTestPkg("lib")
+	app := newTestPkg("app", "lib")
+	other := newTestPkg("other")
+	s := NewScheduler([]*AurPackage{lib, app, other})
+
+	s.Fetched(lib)
+	s.Fetched(app)
+	equals(t, []string{"lib"}, drain(s))
+	assert(t, s.Start(lib), "expected lib to start")
+
+	cancelled := []string{}
+	for _, p := range s.Cancel() {
+		cancelled = append(cancelled, p.Name)
+	}
+	sort.Strings(cancelled)
+	equals(t, []string{"app", "other"}, cancelled)
+
+	// A fetch that finishes or fails after cancelling changes nothing.
+	s.Fetched(other)
+	assert(t, !s.Failed(other), "other failure should not be reported")
+
+	// lib was running; it doesn't release app when it finishes.
+	s.Succeeded(lib)
+	equals(t, []string{}, drain(s))
+	_, open := <-s.Ready()
+	assert(t, !open, "expected Ready to be closed")
+	equals(t, map[string]bool{"app": true, "other": true}, s.Cancelled())
+}
+
+func TestSchedulerInterrupted(t *testing.T) {
+	lib := newTestPkg("lib")
+	s := NewScheduler([]*AurPackage{lib})
+	s.Fetched(lib)
+	equals(t, []string{"lib"}, drain(s))
+	assert(t, s.Start(lib), "expected lib to start")
+	s.Interrupted(lib)
+	equals(t, map[string]bool{"lib": true}, s.Cancelled())
+	_, open := <-s.Ready()
+	assert(t, !open, "expected Ready to be closed")
+}
+
+func TestSchedulerCancelReleased(t *testing.T) {
+	slow := newTestPkg("slow")
+	other := newTestPkg("other")
+	s := NewScheduler([]*AurPackage{slow, other})
+	s.Fetched(slow)
+	s.Fetched(other)
+	equals(t, []string{"other", "slow"}, drain(s))
+	assert(t, s.Start(slow), "expected slow to start")
+
+	// other was released, but no maker had taken it yet.
+	cancelled := []string{}
+	for _, p := range s.Cancel() {
+		cancelled = append(cancelled, p.Name)
+	}
+	equals(t, []string{"other"}, cancelled)
+	assert(t, !s.Start(other), "expected other not to start once cancelled")
+
+	s.Succeeded(slow)
+	_, open := <-s.Ready()
+	assert(t, !open, "expected Ready to be closed")
+	equals(t, map[string]bool{"other": true}, s.Cancelled())
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,217 @@
+// Package srcinfo parses the .SRCINFO files that describe what a
+// PKGBUILD makes, without running it.
+package srcinfo
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Values holds the values given for each key in one section.
+// Architecture-specific keys, such as depends_x86_64, are kept under
+// their full names; see Get.
+type Values map[string][]string
+
+// Get returns the values for key, followed by those for key_arch if
+// arch isn't empty.
+func (v Values) Get(key, arch string) []string {
+	result := append([]string{}, v[key]...)
+	if arch != "" {
+		result = append(result, v[key+"_"+arch]...)
+	}
+	return result
+}
+
+// First returns the first value for key, or "" if there is none.
+func (v Values) First(key string) string {
+	if len(v[key]) == 0 {
+		return ""
+	}
+	return v[key][0]
+}
+
+// SrcInfo is a parsed .SRCINFO file.
+type SrcInfo struct {
+	// Base is the pkgbase.
+	Base string
+	// Values holds the pkgbase section.
+	Values Values
+	// Packages holds one entry per pkgname, in order.
+	Packages []*Package
+}
+
+// Package is one package a PKGBUILD makes.
+type Package struct {
+	Name string
+	// Values holds the pkgbase section, with anything the pkgname
+	// section sets replacing it.
+	Values Values
+}
+
+// Version returns the full version, [epoch:]pkgver-pkgrel.
+func (s *SrcInfo) Version() string {
+	v := s.Values.First("pkgver") + "-" + s.Values.First("pkgrel")
+	if epoch := s.Values.First("epoch"); epoch != "" && epoch != "0" {
+		v = epoch + ":" + v
+	}
+	return v
+}
+
+// ValidPGPKeys returns the fingerprints of the keys sources may be
+// signed with.
+func (s *SrcInfo) ValidPGPKeys() []string {
+	return s.Values["validpgpkeys"]
+}
+
+// Sources returns the sources downloaded when making for arch.
+func (s *SrcInfo) Sources(arch string) []string {
+	return s.Values.Get("source", arch)
+}
+
+// MakeDepends returns everything needed to make the packages for
+// arch, which is depends of every package, plus makedepends and
+// checkdepends.
+func (s *SrcInfo) MakeDepends(arch string) []string {
+	var result []string
+	seen := map[string]bool{}
+	add := func(deps []string) {
+		for _, d := range deps {
+			if !seen[d] {
+				seen[d] = true
+				result = append(result, d)
+			}
+		}
+	}
+	for _, p := range s.Packages {
+		add(p.Depends(arch))
+	}
+	add(s.Values.Get("makedepends", arch))
+	add(s.Values.Get("checkdepends", arch))
+	return result
+}
+
+// Names returns the name of every package made.
+func (s *SrcInfo) Names() []string {
+	result := make([]string, 0, len(s.Packages))
+	for _, p := range s.Packages {
+		result = append(result, p.Name)
+	}
+	return result
+}
+
+// Package returns the package called name, or nil.
+func (s *SrcInfo) Package(name string) *Package {
+	for _, p := range s.Packages {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Depends returns what p needs installed to run on arch.
+func (p *Package) Depends(arch string) []string {
+	return p.Values.Get("depends", arch)
+}
+
+// HostArch returns the name pacman uses for this machine's
+// architecture.
+func HostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i686"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7h"
+	}
+	return runtime.GOARCH
+}
+
+// ParseFile parses the .SRCINFO file at name.
+func ParseFile(name string) (*SrcInfo, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", name)
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	return s, errors.Wrapf(err, "parsing %s", name)
+}
+
+// Parse parses a .SRCINFO file, which is made of lines like
+//
+//	pkgbase = foo
+//		pkgver = 1.0
+//
+//	pkgname = foo
+//		depends = bar
+//
+// A pkgbase section comes first, then a section for each pkgname.
+// Keys may be repeated for lists.  A key given in a pkgname section
+// replaces all of the values for that key from the pkgbase section;
+// an empty value clears them.
+func Parse(r io.Reader) (*SrcInfo, error) {
+	var result *SrcInfo
+	var current Values
+	var pkgValues []Values
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("line %d: expected key = value, got %q", lineNum, line)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch {
+		case key == "pkgbase":
+			if result != nil {
+				return nil, errors.Errorf("line %d: more than one pkgbase", lineNum)
+			}
+			current = Values{}
+			result = &SrcInfo{Base: value, Values: current}
+		case result == nil:
+			return nil, errors.Errorf("line %d: %s before pkgbase", lineNum, key)
+		case key == "pkgname":
+			current = Values{}
+			pkgValues = append(pkgValues, current)
+			result.Packages = append(result.Packages, &Package{Name: value})
+		case value == "":
+			// Present, but empty, so it overrides the pkgbase values.
+			current[key] = []string{}
+		default:
+			current[key] = append(current[key], value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, errors.New("no pkgbase")
+	}
+	if len(result.Packages) == 0 {
+		return nil, errors.New("no pkgname")
+	}
+	for i, p := range result.Packages {
+		p.Values = Values{}
+		for k, v := range result.Values {
+			p.Values[k] = v
+		}
+		for k, v := range pkgValues[i] {
+			p.Values[k] = v
+		}
+	}
+	return result, nil
+}
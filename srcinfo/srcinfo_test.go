@@ -0,0 +1,99 @@
+package srcinfo
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const splitSrcInfo = `# Generated by mksrcinfo
+pkgbase = foo-base
+	pkgdesc = The foo suite
+	pkgver = 2.0
+	pkgrel = 3
+	epoch = 1
+	arch = x86_64
+	arch = aarch64
+	makedepends = cmake
+	depends = glibc
+	depends_x86_64 = lib32-glibc
+	source = https://example.com/foo-2.0.tar.gz
+	source_aarch64 = arm.patch
+	validpgpkeys = 0123456789ABCDEF0123456789ABCDEF01234567
+
+pkgname = foo
+	depends = glibc
+	depends = libbar
+
+pkgname = foo-docs
+	pkgdesc = Documentation for foo
+	arch = any
+	depends =
+	depends_x86_64 =
+`
+
+func TestParse(t *testing.T) {
+	s, err := Parse(strings.NewReader(splitSrcInfo))
+	ok(t, err)
+	equals(t, "foo-base", s.Base)
+	equals(t, "1:2.0-3", s.Version())
+	equals(t, []string{"foo", "foo-docs"}, s.Names())
+	equals(t, []string{"0123456789ABCDEF0123456789ABCDEF01234567"}, s.ValidPGPKeys())
+	equals(t, []string{"https://example.com/foo-2.0.tar.gz"}, s.Sources("x86_64"))
+	equals(t, []string{"https://example.com/foo-2.0.tar.gz", "arm.patch"}, s.Sources("aarch64"))
+
+	foo := s.Package("foo")
+	equals(t, []string{"glibc", "libbar", "lib32-glibc"}, foo.Depends("x86_64"))
+	equals(t, []string{"glibc", "libbar"}, foo.Depends("aarch64"))
+	equals(t, "The foo suite", foo.Values.First("pkgdesc"))
+
+	docs := s.Package("foo-docs")
+	equals(t, []string{}, docs.Depends("x86_64"))
+	equals(t, "Documentation for foo", docs.Values.First("pkgdesc"))
+	equals(t, []string{"any"}, docs.Values["arch"])
+
+	equals(t, []string{"glibc", "libbar", "lib32-glibc", "cmake"}, s.MakeDepends("x86_64"))
+	assert(t, s.Package("bar") == nil, "expected no package bar")
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, text := range []string{
+		"pkgname = foo\n",
+		"pkgbase = foo\n",
+		"pkgbase = foo\npkgname = foo\npkgbase = bar\n",
+		"pkgbase = foo\n\tpkgver 1\n",
+	} {
+		_, err := Parse(strings.NewReader(text))
+		assert(t, err != nil, "expected an error parsing %q", text)
+	}
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,137 @@
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// Format identifies a compression format.
+type Format string
+
+// The compression formats Decompress knows about.
+const (
+	None  Format = "none"
+	Gzip  Format = "gzip"
+	Xz    Format = "xz"
+	Zstd  Format = "zstd"
+	Bzip2 Format = "bzip2"
+)
+
+var magics = []struct {
+	format Format
+	magic  []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{Bzip2, []byte{'B', 'Z', 'h'}},
+}
+
+// Sniff looks at the start of a stream and says how it is compressed.
+func Sniff(head []byte) Format {
+	for _, m := range magics {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+	return None
+}
+
+// ExtractArchive extracts a tar file that may be compressed with any
+// format Decompress understands into root.
+func ExtractArchive(reader io.Reader, root string) error {
+	decompressed, err := Decompress(reader)
+	if err != nil {
+		return errors.Wrap(err, "decompressing")
+	}
+	defer decompressed.Close()
+	return ExtractAll(decompressed, root)
+}
+
+// Decompress looks at the first few bytes of r to decide how it is
+// compressed and returns a reader of the decompressed stream.
+// Handles gzip, xz, zstd and bzip2; streams in any other format are
+// returned as-is.  xz and zstd are handled by running the xz and zstd
+// commands, which must be on the path.  The caller must close the
+// result.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	// An error here means a short stream, which we let the
+	// decompressor complain about.
+	head, _ := br.Peek(8)
+	switch Sniff(head) {
+	case Gzip:
+		return gzip.NewReader(br)
+	case Xz:
+		return command(br, "xz", "--decompress", "--stdout")
+	case Zstd:
+		return command(br, "zstd", "--decompress", "--stdout")
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// cmdReader reads the output of a decompression command.
+type cmdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	waited bool
+	// returned by every Read once the command has exited
+	done error
+}
+
+func command(r io.Reader, name string, args ...string) (io.ReadCloser, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to find %s command", name)
+	}
+	c := &cmdReader{cmd: exec.Command(path, args...)}
+	c.cmd.Stdin = r
+	c.cmd.Stderr = &c.stderr
+	c.stdout, err = c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Getting stdout for %s", name)
+	}
+	if err = c.cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "starting %s", name)
+	}
+	return c, nil
+}
+
+// Read returns an error in place of io.EOF if the command failed, so
+// that corrupt input doesn't look like a short stream.
+func (c *cmdReader) Read(p []byte) (int, error) {
+	if c.done != nil {
+		return 0, c.done
+	}
+	n, err := c.stdout.Read(p)
+	if err == io.EOF {
+		c.waited = true
+		c.done = io.EOF
+		if waitErr := c.cmd.Wait(); waitErr != nil {
+			c.done = errors.Wrapf(waitErr, "%s: %s", c.cmd.Path, bytes.TrimSpace(c.stderr.Bytes()))
+		}
+		return n, c.done
+	}
+	return n, err
+}
+
+// Close stops the command if it is still running.
+func (c *cmdReader) Close() error {
+	if c.waited {
+		return nil
+	}
+	c.waited = true
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
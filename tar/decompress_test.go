@@ -0,0 +1,93 @@
+package tar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func compressWith(t *testing.T, data []byte, name string, args ...string) []byte {
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%s not available", name)
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	ok(t, err)
+	return out
+}
+
+func TestDecompress(t *testing.T) {
+	data := []byte("hello, poltroon\n")
+	cases := []struct {
+		name   string
+		cmd    []string
+		format Format
+	}{
+		{"none", nil, None},
+		{"gzip", []string{"gzip", "-c"}, Gzip},
+		{"xz", []string{"xz", "-c"}, Xz},
+		{"zstd", []string{"zstd", "-c", "-q"}, Zstd},
+		{"bzip2", []string{"bzip2", "-c"}, Bzip2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			compressed := data
+			if tc.cmd != nil {
+				compressed = compressWith(t, data, tc.cmd[0], tc.cmd[1:]...)
+			}
+			equals(t, tc.format, Sniff(compressed))
+
+			r, err := Decompress(bytes.NewReader(compressed))
+			ok(t, err)
+			found, err := ioutil.ReadAll(r)
+			ok(t, err)
+			ok(t, r.Close())
+			equals(t, data, found)
+		})
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	tarData := buildTar(t, []tarEntry{{"pkg/", ""}, {"pkg/PKGBUILD", "pkgname=pkg\n"}}).Bytes()
+	cases := []struct {
+		name string
+		cmd  []string
+	}{
+		{"tar", nil},
+		{"tar.gz", []string{"gzip", "-c"}},
+		{"tar.xz", []string{"xz", "-c"}},
+		{"tar.zst", []string{"zstd", "-c", "-q"}},
+		{"tar.bz2", []string{"bzip2", "-c"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := tarData
+			if tc.cmd != nil {
+				archive = compressWith(t, tarData, tc.cmd[0], tc.cmd[1:]...)
+			}
+			root, err := ioutil.TempDir("", "poltroon_decompress_test")
+			ok(t, err)
+			defer os.RemoveAll(root)
+
+			ok(t, ExtractArchive(bytes.NewReader(archive), root))
+			contents, err := ioutil.ReadFile(path.Join(root, "pkg", "PKGBUILD"))
+			ok(t, err)
+			equals(t, "pkgname=pkg\n", string(contents))
+		})
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	compressed := compressWith(t, []byte("some data that will be damaged"), "xz", "-c")
+	compressed = compressed[:len(compressed)-8]
+
+	r, err := Decompress(bytes.NewReader(compressed))
+	ok(t, err)
+	defer r.Close()
+	_, err = ioutil.ReadAll(r)
+	assert(t, err != nil, "expected truncated xz data to fail")
+}
@@ -2,54 +2,180 @@ package tar
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-type extractor func(r *tar.Reader, h *tar.Header, root string) error
+// Limits guards against archives that would fill the disk.
+type Limits struct {
+	// MaxBytes is the most file content we will write.
+	MaxBytes int64
+	// MaxEntries is the most entries we will read.
+	MaxEntries int
+}
+
+// DefaultLimits are used by ExtractAll.  They are far beyond what any
+// AUR snapshot needs.
+var DefaultLimits = Limits{
+	MaxBytes:   256 << 20,
+	MaxEntries: 10000,
+}
+
+// UnsafeEntryError is returned when an archive entry would be written
+// outside of the root we are extracting to, or breaks one of our
+// Limits.
+type UnsafeEntryError struct {
+	// Name is the name of the entry, as it appears in the archive.
+	Name   string
+	Reason string
+}
+
+func (e *UnsafeEntryError) Error() string {
+	return fmt.Sprintf("unsafe tar entry %q: %s", e.Name, e.Reason)
+}
+
+// extraction holds what we need to remember while extracting a
+// single archive.
+type extraction struct {
+	// root has had its symlinks resolved.
+	root string
+	// Directories get their real permissions and modification times
+	// once everything inside them has been written.
+	dirs []*dirMeta
+}
+
+type dirMeta struct {
+	dest    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+type extractor func(x *extraction, r *tar.Reader, h *tar.Header, dest string) error
 
 // maps from tar.Header.TypeFlag to a function that knows how to extract it.
 var extractorMap = map[byte]extractor{
-	tar.TypeReg:           extractFile,
-	tar.TypeRegA:          extractFile,
-	tar.TypeDir:           extractDir,
-	tar.TypeXGlobalHeader: ignore, // AUR packages fill this with the commit id.
+	tar.TypeReg:           (*extraction).extractFile,
+	tar.TypeRegA:          (*extraction).extractFile,
+	tar.TypeDir:           (*extraction).extractDir,
+	tar.TypeSymlink:       (*extraction).extractSymlink,
+	tar.TypeLink:          (*extraction).extractLink,
+	tar.TypeXGlobalHeader: (*extraction).ignore, // AUR packages fill this with the commit id.
 }
 
-// ExtractAll extracts the tar file in r and puts it into root.
-// Currently only supports files and directories.
+// ExtractAll extracts the tar file in r and puts it into root, using
+// DefaultLimits.
 func ExtractAll(reader io.Reader, root string) error {
+	return ExtractAllWithLimits(reader, root, DefaultLimits)
+}
+
+// ExtractAllWithLimits extracts the tar file in r and puts it into
+// root.  Supports files, directories, symlinks and hard links, and
+// restores permissions and modification times.  Entries that would
+// end up outside of root, whether through .. components, absolute
+// names or symlinks, are rejected with an *UnsafeEntryError, as are
+// links pointing outside of root and archives that exceed limits.
+func ExtractAllWithLimits(reader io.Reader, root string, limits Limits) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return errors.Wrapf(err, "resolving %s", root)
+	}
+	x := &extraction{root: realRoot}
 	r := tar.NewReader(reader)
+	var totalBytes int64
+	entries := 0
 	for {
 		header, err := r.Next()
 		if err == io.EOF {
-			return nil
+			return x.finishDirs()
 		}
 		if err != nil {
 			return errors.Wrap(err, "r.Next()")
 		}
+		entries++
+		if entries > limits.MaxEntries {
+			return &UnsafeEntryError{header.Name, fmt.Sprintf("archive has more than %d entries", limits.MaxEntries)}
+		}
 		extractFunc, ok := extractorMap[header.Typeflag]
 		if !ok {
 			return errors.Errorf("Unknown TypeFlag %x for %s", header.Typeflag, header.Name)
 		}
-		err = extractFunc(r, header, root)
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		totalBytes += header.Size
+		if totalBytes > limits.MaxBytes {
+			return &UnsafeEntryError{header.Name, fmt.Sprintf("archive has more than %d bytes", limits.MaxBytes)}
+		}
+		dest, err := safeJoin(realRoot, header.Name)
+		if err != nil {
+			return err
+		}
+		err = extractFunc(x, r, header, dest)
 		if err != nil {
 			return err
 		}
 	}
 }
 
-func ignore(r *tar.Reader, h *tar.Header, root string) error {
+// safeJoin returns where the entry called name should go under root,
+// as long as that is really under root.  root must already have had
+// its symlinks resolved.
+func safeJoin(root, name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", &UnsafeEntryError{name, "absolute path"}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &UnsafeEntryError{name, "path escapes the extraction root"}
+	}
+	dest := path.Join(root, cleaned)
+
+	// Writing to a symlink would write wherever it points.
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return "", &UnsafeEntryError{name, "would write through a symlink"}
+	}
+
+	// Any parent directory that already exists might be, or be
+	// under, a symlink pointing somewhere else.
+	parent := path.Dir(dest)
+	for parent != root && !exists(parent) {
+		parent = path.Dir(parent)
+	}
+	resolved, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving parent of %s", name)
+	}
+	if !within(root, resolved) {
+		return "", &UnsafeEntryError{name, "path escapes the extraction root through a symlink"}
+	}
+	return dest, nil
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// within returns true if p is root or is under it.
+func within(root, p string) bool {
+	return p == root || strings.HasPrefix(p, root+"/")
+}
+
+func (x *extraction) ignore(r *tar.Reader, h *tar.Header, dest string) error {
 	return nil
 }
 
-func extractFile(r *tar.Reader, h *tar.Header, root string) error {
-	dest := path.Join(root, h.Name)
+func (x *extraction) extractFile(r *tar.Reader, h *tar.Header, dest string) (err error) {
 	fileInfo := h.FileInfo()
-	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileInfo.Mode())
+	// Perm() leaves out setuid and friends, which we never want.
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileInfo.Mode().Perm())
 	if err != nil {
 		return err
 	}
@@ -58,14 +184,114 @@ func extractFile(r *tar.Reader, h *tar.Header, root string) error {
 		if err == nil {
 			err = closeErr
 		}
+		if err == nil {
+			err = os.Chtimes(dest, h.ModTime, h.ModTime)
+		}
 	}()
 
 	_, err = io.Copy(f, r)
 	return err
 }
 
-func extractDir(r *tar.Reader, h *tar.Header, root string) error {
-	dest := path.Join(root, h.Name)
-	fileInfo := h.FileInfo()
-	return os.MkdirAll(dest, fileInfo.Mode())
+// Directories start out writable by us, so that read-only ones can
+// still be filled.  finishDirs sets their real permissions.
+func (x *extraction) extractDir(r *tar.Reader, h *tar.Header, dest string) error {
+	if err := os.MkdirAll(dest, 0700); err != nil {
+		return err
+	}
+	x.dirs = append(x.dirs, &dirMeta{dest, h.FileInfo().Mode().Perm(), h.ModTime})
+	return nil
+}
+
+// Symlinks may only point somewhere inside root, and only by a
+// relative path, so that they mean the same thing wherever root is.
+func (x *extraction) extractSymlink(r *tar.Reader, h *tar.Header, dest string) error {
+	if path.IsAbs(h.Linkname) {
+		return &UnsafeEntryError{h.Name, fmt.Sprintf("symlink to absolute path %q", h.Linkname)}
+	}
+	if reason := x.checkLinkname(path.Dir(dest), h.Linkname); reason != "" {
+		return &UnsafeEntryError{h.Name, fmt.Sprintf("symlink to %q %s", h.Linkname, reason)}
+	}
+	return os.Symlink(h.Linkname, dest)
+}
+
+// checkLinkname follows linkname from dir one component at a time,
+// the way the kernel will, and says why it isn't safe, or returns ""
+// if it is.  Cleaning linkname first would be wrong, since a .. after
+// a symlink we already extracted goes to the parent of wherever that
+// symlink points.
+//
+// Once we reach something that hasn't been extracted yet, we can't
+// know what a .. after it will mean, so we don't allow one.  Anything
+// else below it must be extracted later, and will get checked then.
+func (x *extraction) checkLinkname(dir, linkname string) string {
+	cur, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Sprintf("can't be checked: %v", err)
+	}
+	missing := false
+	for _, c := range strings.Split(linkname, "/") {
+		switch {
+		case c == "" || c == ".":
+		case c == "..":
+			if missing {
+				return fmt.Sprintf("goes through %s, which hasn't been extracted yet", cur)
+			}
+			cur = path.Dir(cur)
+		case missing:
+			cur = path.Join(cur, c)
+		default:
+			cur = path.Join(cur, c)
+			if _, err := os.Lstat(cur); err != nil {
+				missing = true
+				break
+			}
+			// Dangling symlinks are like anything else that
+			// hasn't been extracted yet.
+			resolved, err := filepath.EvalSymlinks(cur)
+			if err != nil {
+				missing = true
+				break
+			}
+			cur = resolved
+		}
+		if !within(x.root, cur) {
+			return "escapes the extraction root"
+		}
+	}
+	return ""
+}
+
+// Hard links name another entry in the archive, which must be a
+// regular file we already extracted.
+func (x *extraction) extractLink(r *tar.Reader, h *tar.Header, dest string) error {
+	target, err := safeJoin(x.root, h.Linkname)
+	if err != nil {
+		return &UnsafeEntryError{h.Name, fmt.Sprintf("hard link to %q: %v", h.Linkname, err)}
+	}
+	info, err := os.Lstat(target)
+	if err != nil {
+		return errors.Wrapf(err, "hard link %s", h.Name)
+	}
+	if !info.Mode().IsRegular() {
+		return &UnsafeEntryError{h.Name, fmt.Sprintf("hard link to %q, which is not a regular file", h.Linkname)}
+	}
+	return os.Link(target, dest)
+}
+
+// finishDirs gives directories their real permissions and
+// modification times.  Archives list parents before children, so
+// going backwards means a locked-down parent can't stop us from
+// fixing its children.
+func (x *extraction) finishDirs() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		if err := os.Chmod(d.dest, d.mode); err != nil {
+			return err
+		}
+		if err := os.Chtimes(d.dest, d.modTime, d.modTime); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,6 +1,8 @@
 package tar
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -11,6 +13,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestExtractAll(t *testing.T) {
@@ -43,6 +46,191 @@ func TestExtractAll(t *testing.T) {
 	equals(t, expected, found)
 }
 
+// tarEntry describes an entry for buildTar.  Names ending in / are
+// directories.
+type tarEntry struct {
+	name     string
+	contents string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.contents))}
+		if strings.HasSuffix(e.name, "/") {
+			h.Typeflag = tar.TypeDir
+			h.Mode = 0755
+		}
+		ok(t, tw.WriteHeader(h))
+		_, err := tw.Write([]byte(e.contents))
+		ok(t, err)
+	}
+	ok(t, tw.Close())
+	return &buf
+}
+
+func TestExtractUnsafe(t *testing.T) {
+	workarea, err := ioutil.TempDir("", "poltroon_extract_test")
+	ok(t, err)
+	defer os.RemoveAll(workarea)
+	outside := path.Join(workarea, "outside")
+	ok(t, os.MkdirAll(outside, 0755))
+
+	small := Limits{MaxBytes: 10, MaxEntries: 3}
+	cases := []struct {
+		name    string
+		entries []tarEntry
+		limits  Limits
+		bad     string
+	}{
+		{"dotdot", []tarEntry{{"../evil", "x"}}, DefaultLimits, "../evil"},
+		{"nested dotdot", []tarEntry{{"a/", ""}, {"a/../../evil", "x"}}, DefaultLimits, "a/../../evil"},
+		{"absolute", []tarEntry{{"/tmp/evil", "x"}}, DefaultLimits, "/tmp/evil"},
+		{"symlinked dir", []tarEntry{{"link/evil", "x"}}, DefaultLimits, "link/evil"},
+		{"through symlink", []tarEntry{{"filelink", "x"}}, DefaultLimits, "filelink"},
+		{"through symlink chain", []tarEntry{{"chain/outside/evil", "x"}}, DefaultLimits, "chain/outside/evil"},
+		{"too many", []tarEntry{{"a", ""}, {"b", ""}, {"c", ""}, {"d", ""}}, small, "d"},
+		{"too big", []tarEntry{{"a", "12345"}, {"b", "678901"}}, small, "b"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root := path.Join(workarea, strings.Replace(tc.name, " ", "_", -1))
+			ok(t, os.MkdirAll(root, 0755))
+			ok(t, os.Symlink(outside, path.Join(root, "link")))
+			ok(t, os.Symlink(path.Join(outside, "target"), path.Join(root, "filelink")))
+			ok(t, os.MkdirAll(path.Join(root, "d/e"), 0755))
+			ok(t, os.Symlink("../..", path.Join(root, "d/e/up")))
+			ok(t, os.Symlink("d/e/up/..", path.Join(root, "chain")))
+
+			err := ExtractAllWithLimits(buildTar(t, tc.entries), root, tc.limits)
+			unsafe, isUnsafe := err.(*UnsafeEntryError)
+			assert(t, isUnsafe, "expected an UnsafeEntryError, got %v", err)
+			equals(t, tc.bad, unsafe.Name)
+
+			written, err := ioutil.ReadDir(outside)
+			ok(t, err)
+			equals(t, 0, len(written))
+		})
+	}
+}
+
+func TestExtractSafeDotDot(t *testing.T) {
+	root, err := ioutil.TempDir("", "poltroon_extract_test")
+	ok(t, err)
+	defer os.RemoveAll(root)
+
+	ok(t, ExtractAll(buildTar(t, []tarEntry{{"a/", ""}, {"a/../b", "b"}}), root))
+	contents, err := ioutil.ReadFile(path.Join(root, "b"))
+	ok(t, err)
+	equals(t, "b", string(contents))
+}
+
+func TestExtractTypes(t *testing.T) {
+	workarea, err := ioutil.TempDir("", "poltroon_extract_test")
+	ok(t, err)
+	defer func() {
+		// Make sure we can clean up the read-only directories
+		filepath.Walk(workarea, func(p string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(p, 0755)
+			}
+			return nil
+		})
+		os.RemoveAll(workarea)
+	}()
+
+	pristine := path.Join(workarea, "pristine")
+	writeToDisk(t, pristine, []string{
+		"pkg/",
+		"pkg/PKGBUILD",
+		"pkg/patches/",
+		"pkg/patches/fix.patch",
+		"pkg/readonly/",
+		"pkg/readonly/inside.txt",
+	})
+	ok(t, os.Symlink("patches/fix.patch", path.Join(pristine, "pkg/link.patch")))
+	ok(t, os.Link(path.Join(pristine, "pkg/PKGBUILD"), path.Join(pristine, "pkg/hardlink")))
+	modTime := time.Date(2016, 10, 17, 12, 0, 0, 0, time.UTC)
+	ok(t, os.Chtimes(path.Join(pristine, "pkg/PKGBUILD"), modTime, modTime))
+	ok(t, os.Chtimes(path.Join(pristine, "pkg/patches"), modTime, modTime))
+	ok(t, os.Chmod(path.Join(pristine, "pkg/readonly"), 0555))
+
+	tarFile := path.Join(workarea, "test.tar")
+	makeTar(t, pristine, tarFile)
+
+	extracted := path.Join(workarea, "extracted")
+	ok(t, os.MkdirAll(extracted, 0755))
+	reader, err := os.Open(tarFile)
+	ok(t, err)
+	defer reader.Close()
+	ok(t, ExtractAll(reader, extracted))
+
+	link, err := os.Readlink(path.Join(extracted, "pkg/link.patch"))
+	ok(t, err)
+	equals(t, "patches/fix.patch", link)
+	contents, err := ioutil.ReadFile(path.Join(extracted, "pkg/link.patch"))
+	ok(t, err)
+	equals(t, "fix.patch", string(contents))
+
+	pkgbuild, err := os.Stat(path.Join(extracted, "pkg/PKGBUILD"))
+	ok(t, err)
+	hardlink, err := os.Stat(path.Join(extracted, "pkg/hardlink"))
+	ok(t, err)
+	assert(t, os.SameFile(pkgbuild, hardlink), "expected hardlink to be the same file as PKGBUILD")
+	assert(t, pkgbuild.ModTime().Equal(modTime), "expected PKGBUILD mod time %s, got %s", modTime, pkgbuild.ModTime())
+
+	patches, err := os.Stat(path.Join(extracted, "pkg/patches"))
+	ok(t, err)
+	assert(t, patches.ModTime().Equal(modTime), "expected patches mod time %s, got %s", modTime, patches.ModTime())
+
+	readonly, err := os.Stat(path.Join(extracted, "pkg/readonly"))
+	ok(t, err)
+	equals(t, os.FileMode(0555), readonly.Mode().Perm())
+	contents, err = ioutil.ReadFile(path.Join(extracted, "pkg/readonly/inside.txt"))
+	ok(t, err)
+	equals(t, "inside.txt", string(contents))
+}
+
+func TestExtractUnsafeLinks(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"absolute symlink", []tar.Header{{Name: "a", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}}},
+		{"escaping symlink", []tar.Header{{Name: "d/a", Linkname: "../../outside", Typeflag: tar.TypeSymlink}}},
+		{"escaping hardlink", []tar.Header{{Name: "a", Linkname: "../outside", Typeflag: tar.TypeLink}}},
+		{"hardlink to dir", []tar.Header{{Name: "a", Linkname: "d", Typeflag: tar.TypeLink}}},
+		{"symlink chain", []tar.Header{
+			{Name: "d/e/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "d/e/up", Linkname: "../..", Typeflag: tar.TypeSymlink},
+			{Name: "x", Linkname: "d/e/up/..", Typeflag: tar.TypeSymlink},
+		}},
+		{"symlink through missing", []tar.Header{{Name: "d/a", Linkname: "later/../b", Typeflag: tar.TypeSymlink}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "poltroon_extract_test")
+			ok(t, err)
+			defer os.RemoveAll(root)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			ok(t, tw.WriteHeader(&tar.Header{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755}))
+			for _, h := range tc.headers {
+				h := h
+				ok(t, tw.WriteHeader(&h))
+			}
+			ok(t, tw.Close())
+
+			err = ExtractAll(&buf, root)
+			unsafe, isUnsafe := err.(*UnsafeEntryError)
+			assert(t, isUnsafe, "expected an UnsafeEntryError, got %v", err)
+			equals(t, tc.headers[len(tc.headers)-1].Name, unsafe.Name)
+		})
+	}
+}
+
 func writeToDisk(t *testing.T, root string, tree []string) {
 	for _, name := range tree {
 		joined := path.Join(root, name)
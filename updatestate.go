@@ -1,101 +1,190 @@
 package poltroon
 
 import (
-	"fmt"
-	"sort"
-	"strings"
 	"sync"
 	"time"
 )
 
+// EventType says what happened to a package.
+type EventType int
+
+// The things that can happen to a package.  Each package ends with
+// exactly one of FetchFailed, MakeSucceeded, MakeFailed, Cancelled,
+// Skipped or Limited.
+const (
+	FetchStarted EventType = iota
+	FetchFailed
+	MakeStarted
+	MakeSucceeded
+	MakeFailed
+	Cancelled
+	Skipped
+	Limited
+)
+
+var eventNames = map[EventType]string{
+	FetchStarted:  "FetchStarted",
+	FetchFailed:   "FetchFailed",
+	MakeStarted:   "MakeStarted",
+	MakeSucceeded: "MakeSucceeded",
+	MakeFailed:    "MakeFailed",
+	Cancelled:     "Cancelled",
+	Skipped:       "Skipped",
+	Limited:       "Limited",
+}
+
+func (t EventType) String() string {
+	return eventNames[t]
+}
+
+// Final returns true if t is the last event for a package.
+func (t EventType) Final() bool {
+	return t != FetchStarted && t != MakeStarted
+}
+
+// Event is something that happened to one package.
+type Event struct {
+	Type    EventType
+	Package string
+	Time    time.Time
+	// Duration is how long the fetch or make took, for FetchFailed,
+	// MakeSucceeded, MakeFailed and Limited.
+	Duration time.Duration
+	// Err says what went wrong, for FetchFailed, MakeFailed, Skipped
+	// and Limited.
+	Err error
+	// Logs is the directory holding the package's log files.
+	Logs string
+}
+
 // UpdateState tracks the state of the update process.  Can be
-// consulted to know when we are done, and to get an idea of the
-// progress
+// consulted to know when we are done, and sends events describing
+// progress to any subscribers.
 type UpdateState struct {
-	// Makes gets an entry whenever a make starts or finishes.  It gets closed
-	// once they all complete.
-	Makes chan string
-
 	attempting int // total packages to attempt
 
 	waitGroup sync.WaitGroup
 
-	mu        sync.Mutex           // protects this group
-	beingMade map[string]time.Time // what we are currently making and when we started
-	finished  int                  // number packages finished
+	mu          sync.Mutex           // protects this group
+	started     map[string]time.Time // when the current fetch or make of each package started
+	finished    int                  // number packages finished
+	subscribers []chan Event
 }
 
 // NewUpdateState returns a new UpdateState.
 func NewUpdateState(pkgCnt int) *UpdateState {
 	result := &UpdateState{
-		Makes:      make(chan string),
 		attempting: pkgCnt,
-		beingMade:  make(map[string]time.Time),
+		started:    make(map[string]time.Time),
 	}
 	result.waitGroup.Add(pkgCnt)
 	return result
 }
 
-// StartMake records the fact that we are now making the named package.
-func (u *UpdateState) StartMake(name string) {
+// Attempting returns how many packages we are trying to make.
+func (u *UpdateState) Attempting() int {
+	return u.attempting
+}
+
+// Subscribe returns a channel that gets every event from now on.  It
+// gets closed once every package has finished.  Subscribers should
+// subscribe before anything starts, and need not keep up: events are
+// buffered.
+func (u *UpdateState) Subscribe() <-chan Event {
 	u.mu.Lock()
-	u.beingMade[name] = time.Now()
-	progress := u.progress()
-	u.mu.Unlock()
-	u.Makes <- progress + "\r"
+	defer u.mu.Unlock()
+	// At most a fetch start, a make start and a final event each.
+	c := make(chan Event, 3*u.attempting)
+	if u.finished == u.attempting {
+		close(c)
+	} else {
+		u.subscribers = append(u.subscribers, c)
+	}
+	return c
+}
+
+// FetchStarted records that we started fetching pkg.
+func (u *UpdateState) FetchStarted(pkg *AurPackage) {
+	u.send(FetchStarted, pkg, nil)
+}
+
+// FetchFailed records that we couldn't fetch pkg.
+func (u *UpdateState) FetchFailed(pkg *AurPackage, err error) {
+	u.send(FetchFailed, pkg, err)
 }
 
-// Finished records the fact that we are now done with the named package.
-func (u *UpdateState) Finished(name string) {
-	done := false
+// MakeStarted records that we are now making pkg.
+func (u *UpdateState) MakeStarted(pkg *AurPackage) {
+	u.send(MakeStarted, pkg, nil)
+}
+
+// MakeSucceeded records that pkg was made.
+func (u *UpdateState) MakeSucceeded(pkg *AurPackage) {
+	u.send(MakeSucceeded, pkg, nil)
+}
+
+// MakeFailed records that making pkg failed.
+func (u *UpdateState) MakeFailed(pkg *AurPackage, err error) {
+	u.send(MakeFailed, pkg, err)
+}
+
+// Cancelled records that pkg won't be made because we were
+// interrupted.
+func (u *UpdateState) Cancelled(pkg *AurPackage) {
+	u.send(Cancelled, pkg, nil)
+}
+
+// Skipped records that pkg won't be made, for the reason in err.
+func (u *UpdateState) Skipped(pkg *AurPackage, err error) {
+	u.send(Skipped, pkg, err)
+}
+
+// Limited records that pkg was stopped, or never started, because it
+// went over a limit.  err says which.
+func (u *UpdateState) Limited(pkg *AurPackage, err error) {
+	u.send(Limited, pkg, err)
+}
+
+func (u *UpdateState) send(t EventType, pkg *AurPackage, err error) {
+	now := time.Now()
+	e := Event{
+		Type:    t,
+		Package: pkg.Name,
+		Time:    now,
+		Err:     err,
+		Logs:    pkg.Logs(),
+	}
+
 	u.mu.Lock()
-	start, ok := u.beingMade[name]
-	if ok {
-		delete(u.beingMade, name)
+	if start, ok := u.started[pkg.Name]; ok && t != MakeStarted {
+		e.Duration = now.Sub(start)
+	}
+	switch {
+	case t == FetchStarted || t == MakeStarted:
+		u.started[pkg.Name] = now
+	case t.Final():
+		delete(u.started, pkg.Name)
 		u.finished++
-		if u.finished == u.attempting {
-			done = true
+	}
+	// Sending while locked keeps events in order.  The channels are
+	// big enough that this never blocks.
+	for _, c := range u.subscribers {
+		c <- e
+	}
+	if t.Final() && u.finished == u.attempting {
+		for _, c := range u.subscribers {
+			close(c)
 		}
+		u.subscribers = nil
 	}
-	progress := u.progress()
 	u.mu.Unlock()
-	if ok {
-		duration := time.Since(start)
-		u.Makes <- fmt.Sprintf("Made %s in %s\n", name, duration)
-	}
-	if done {
-		u.Makes <- ""
-		close(u.Makes)
-	} else {
-		u.Makes <- progress + "\r"
+
+	if t.Final() {
+		u.waitGroup.Done()
 	}
-	u.waitGroup.Done()
 }
 
 // Wait blocks until all packages are done
 func (u *UpdateState) Wait() {
 	u.waitGroup.Wait()
 }
-
-// Assume the terminal is at least 60 chars wide and that we are
-// handling less than 100 packages.
-const availableCols = 60 - len("(33/44))")
-
-// Assumes the caller holds a lock.
-func (u *UpdateState) progress() string {
-	making := make([]string, 0, len(u.beingMade))
-	for key := range u.beingMade {
-		making = append(making, key)
-	}
-	// Forcing this into a predictable order will avoid the output
-	// changing when nothing changed
-	sort.Strings(making)
-	currentlyMaking := ""
-	if len(making) > 0 {
-		currentlyMaking = fmt.Sprintf(" Making %s", strings.Join(making, ", "))
-		if len(currentlyMaking) > availableCols {
-			currentlyMaking = fmt.Sprintf(" Making %d packages", len(making))
-		}
-	}
-	return fmt.Sprintf("(%d/%d)%s", u.finished, u.attempting, currentlyMaking)
-}
@@ -0,0 +1,86 @@
+package poltroon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestUpdateStateEvents(t *testing.T) {
+	foo := newTestPkg("foo")
+	bar := newTestPkg("bar")
+	u := NewUpdateState(2)
+	events := u.Subscribe()
+
+	u.FetchStarted(foo)
+	u.FetchStarted(bar)
+	u.FetchFailed(bar, errors.New("no snapshot"))
+	u.MakeStarted(foo)
+	u.MakeSucceeded(foo)
+	u.Wait()
+
+	var got []EventType
+	var last []Event
+	for e := range events {
+		got = append(got, e.Type)
+		last = append(last, e)
+	}
+	equals(t, []EventType{FetchStarted, FetchStarted, FetchFailed, MakeStarted, MakeSucceeded}, got)
+
+	failed := last[2]
+	equals(t, "bar", failed.Package)
+	equals(t, "no snapshot", failed.Err.Error())
+	equals(t, bar.Logs(), failed.Logs)
+	assert(t, failed.Duration > 0, "fetch duration %s", failed.Duration)
+
+	made := last[4]
+	equals(t, made.Time.Sub(last[3].Time), made.Duration)
+
+	// Subscribing once everything is done gets a closed channel.
+	_, open := <-u.Subscribe()
+	assert(t, !open, "expected closed channel")
+}
+
+func TestRenderText(t *testing.T) {
+	foo := newTestPkg("foo")
+	bar := newTestPkg("bar")
+	baz := newTestPkg("baz")
+	slow := newTestPkg("slow")
+	late := newTestPkg("late")
+	u := NewUpdateState(5)
+	events := u.Subscribe()
+
+	u.MakeStarted(foo)
+	u.MakeStarted(bar)
+	u.MakeFailed(bar, errors.New("oops"))
+	u.Skipped(baz, errors.New("bar failed"))
+	u.MakeStarted(slow)
+	u.Limited(slow, errors.New("took longer than 1h"))
+	u.Limited(late, errors.New("not started within 3h"))
+	u.MakeSucceeded(foo)
+
+	var buf bytes.Buffer
+	RenderText(&buf, 5, events)
+	equals(t, 3, bytes.Count(buf.Bytes(), []byte("\n")))
+	lines := []string{
+		"(0/5) Making foo\r",
+		"(0/5) Making bar, foo\r",
+		"Failed to make bar after ",
+		"(1/5) Making foo\r",
+		"(2/5) Making foo\r",
+		"(2/5) Making foo, slow\r",
+		"Stopped making slow after ",
+		": took longer than 1h\n",
+		"(3/5) Making foo\r",
+		"(4/5) Making foo\r",
+		"Made foo in ",
+	}
+	rest := buf.String()
+	for _, l := range lines {
+		i := strings.Index(rest, l)
+		assert(t, i != -1, "missing %q in %q", l, rest)
+		rest = rest[i+len(l):]
+	}
+}
@@ -0,0 +1,118 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Revisions maps source entries, as written in the PKGBUILD, to the
+// upstream revision they were at.
+type Revisions map[string]string
+
+// Current looks up the upstream revision of each source we can check,
+// with command.  Other sources, and ones pinned to a fixed revision,
+// are left out.
+func Current(ctx context.Context, command Commander, sources []string) (Revisions, error) {
+	result := Revisions{}
+	for _, s := range sources {
+		src, ok := ParseSource(s)
+		if !ok || src.Pinned() {
+			continue
+		}
+		head, err := Head(ctx, command, src)
+		if err != nil {
+			return nil, err
+		}
+		result[s] = head
+	}
+	return result, nil
+}
+
+// Changed returns the sources in revs whose upstream revision is no
+// longer the one recorded, checking with command.
+func Changed(ctx context.Context, command Commander, revs Revisions) ([]string, error) {
+	var result []string
+	for s, rev := range revs {
+		current, err := Current(ctx, command, []string{s})
+		if err != nil {
+			return nil, err
+		}
+		if head, ok := current[s]; ok && head != rev {
+			result = append(result, s)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// Store remembers the revisions that packages were last made from, in
+// a json file.
+type Store struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewStore returns a Store that keeps its data in the file at name.
+func NewStore(name string) *Store {
+	return &Store{Path: name}
+}
+
+// Get returns the revisions the named package was last made from, or
+// nil if we don't know.
+func (s *Store) Get(name string) (Revisions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return all[name], nil
+}
+
+// Set records that the named packages were made from revs.
+func (s *Store) Set(names []string, revs Revisions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		all[n] = revs
+	}
+	b, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "encoding revisions")
+	}
+	if err = os.MkdirAll(path.Dir(s.Path), 0755); err != nil {
+		return errors.Wrapf(err, "creating %s", path.Dir(s.Path))
+	}
+	tmp := s.Path + ".tmp"
+	if err = ioutil.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "writing %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, s.Path), "replacing %s", s.Path)
+}
+
+func (s *Store) read() (map[string]Revisions, error) {
+	all := map[string]Revisions{}
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", s.Path)
+	}
+	if err = json.Unmarshal(b, &all); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", s.Path)
+	}
+	return all, nil
+}
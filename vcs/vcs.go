@@ -0,0 +1,142 @@
+// Package vcs works out whether the upstream sources of development
+// packages, such as foo-git, have changed since they were made.
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Source is a version control source from a PKGBUILD, such as
+//
+//	foo::git+https://example.com/foo.git#branch=stable
+type Source struct {
+	// Kind is git, hg or svn.
+	Kind string
+	// URL is where to look, without the kind or fragment.
+	URL string
+	// Fragment names the branch, tag, commit and so on, e.g.
+	// branch=stable.  Empty means the default branch.
+	Fragment string
+}
+
+// Kinds of source we know how to check.
+var kinds = []string{"git", "hg", "svn"}
+
+// ParseSource parses a source entry, returning false if it isn't one
+// we can check.
+func ParseSource(s string) (Source, bool) {
+	if i := strings.Index(s, "::"); i != -1 {
+		s = s[i+2:]
+	}
+	var src Source
+	if i := strings.Index(s, "#"); i != -1 {
+		s, src.Fragment = s[:i], stripQuery(s[i+1:])
+	}
+	s = stripQuery(s)
+	for _, k := range kinds {
+		switch {
+		case strings.HasPrefix(s, k+"+"):
+			src.Kind, src.URL = k, strings.TrimPrefix(s, k+"+")
+		case strings.HasPrefix(s, k+"://"):
+			src.Kind, src.URL = k, s
+		}
+	}
+	// The URL is passed to git and friends, which would take one
+	// starting with a dash as an option.
+	if src.Kind == "" || strings.HasPrefix(src.URL, "-") {
+		return Source{}, false
+	}
+	return src, true
+}
+
+// Queries, such as ?signed, say how to check a source, not where it
+// is.
+func stripQuery(s string) string {
+	if i := strings.Index(s, "?"); i != -1 {
+		return s[:i]
+	}
+	return s
+}
+
+// Pinned returns true if the source names a fixed revision, so it
+// never moves.
+func (s Source) Pinned() bool {
+	key := strings.SplitN(s.Fragment, "=", 2)[0]
+	return key == "tag" || key == "commit" || key == "revision"
+}
+
+func (s Source) String() string {
+	result := s.Kind + "+" + s.URL
+	if s.Fragment != "" {
+		result += "#" + s.Fragment
+	}
+	return result
+}
+
+// Commander makes the commands that look upstream, the way
+// exec.CommandContext does.  Callers can use one that runs them in a
+// sandbox.  nil means exec.CommandContext.
+type Commander func(ctx context.Context, name string, args ...string) *exec.Cmd
+
+// Head returns the newest upstream revision of s, running what it
+// needs with command.  git sources are checked with git ls-remote, so
+// a local repository works as well as a remote one.
+func Head(ctx context.Context, command Commander, s Source) (string, error) {
+	value := ""
+	if parts := strings.SplitN(s.Fragment, "=", 2); len(parts) == 2 {
+		value = parts[1]
+	}
+	var out []byte
+	var err error
+	switch s.Kind {
+	case "git":
+		ref := "HEAD"
+		if value != "" {
+			ref = "refs/heads/" + value
+		}
+		out, err = run(ctx, command, "git", "ls-remote", "--", s.URL, ref)
+	case "hg":
+		rev := "default"
+		if value != "" {
+			rev = value
+		}
+		out, err = run(ctx, command, "hg", "identify", "--id", "--rev", rev, "--", s.URL)
+	case "svn":
+		out, err = run(ctx, command, "svn", "info", "--show-item", "last-changed-revision", "--", s.URL)
+	default:
+		return "", errors.Errorf("don't know how to check %s", s)
+	}
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", errors.Errorf("no revision found for %s", s)
+	}
+	return fields[0], nil
+}
+
+func run(ctx context.Context, command Commander, name string, args ...string) ([]byte, error) {
+	if command == nil {
+		command = exec.CommandContext
+	}
+	cmd := command(ctx, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	// Never wait for someone to type a password.
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s: %s", name, strings.Join(args, " "), bytes.TrimSpace(stderr.Bytes()))
+	}
+	return out, nil
+}
@@ -0,0 +1,133 @@
+package vcs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected Source
+		ok       bool
+		pinned   bool
+	}{
+		{"git+https://example.com/foo.git", Source{"git", "https://example.com/foo.git", ""}, true, false},
+		{"foo::git+https://example.com/foo.git#branch=dev", Source{"git", "https://example.com/foo.git", "branch=dev"}, true, false},
+		{"git://example.com/foo.git#tag=v1.0?signed", Source{"git", "git://example.com/foo.git", "tag=v1.0"}, true, true},
+		{"git+https://example.com/foo.git?signed#commit=abc", Source{"git", "https://example.com/foo.git", "commit=abc"}, true, true},
+		{"hg+https://example.com/foo", Source{"hg", "https://example.com/foo", ""}, true, false},
+		{"svn+https://example.com/foo/trunk", Source{"svn", "https://example.com/foo/trunk", ""}, true, false},
+		{"https://example.com/foo-1.0.tar.gz", Source{}, false, false},
+		{"foo.patch", Source{}, false, false},
+		{"foo::git+--upload-pack=touch /tmp/pwned;", Source{}, false, false},
+		{"hg+-e sh", Source{}, false, false},
+	}
+	for _, test := range tests {
+		src, ok := ParseSource(test.source)
+		equals(t, test.ok, ok)
+		equals(t, test.expected, src)
+		equals(t, test.pinned, src.Pinned())
+	}
+}
+
+// gitCmd runs git in dir, as a test user.
+func gitCmd(t *testing.T, dir string, args ...string) string {
+	args = append([]string{"-c", "user.name=Test", "-c", "user.email=test@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	ok(t, err)
+	return string(bytes.TrimSpace(out))
+}
+
+func TestChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "poltroon_vcs_test")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	// A local repository stands in for upstream.
+	upstream := path.Join(dir, "upstream")
+	gitCmd(t, dir, "init", "--quiet", "--initial-branch=master", upstream)
+	gitCmd(t, upstream, "commit", "--quiet", "--allow-empty", "-m", "one")
+	gitCmd(t, upstream, "branch", "stable")
+	first := gitCmd(t, upstream, "rev-parse", "HEAD")
+
+	sources := []string{
+		"foo::git+" + upstream,
+		"git+" + upstream + "#branch=stable",
+		"git+" + upstream + "#tag=v1",
+		"foo.patch",
+	}
+	ctx := context.Background()
+	revs, err := Current(ctx, nil, sources)
+	ok(t, err)
+	equals(t, Revisions{sources[0]: first, sources[1]: first}, revs)
+
+	store := NewStore(path.Join(dir, "cache", "vcs.json"))
+	got, err := store.Get("foo-git")
+	ok(t, err)
+	assert(t, got == nil, "expected nothing recorded yet")
+	ok(t, store.Set([]string{"foo-git", "foo-docs-git"}, revs))
+	got, err = NewStore(store.Path).Get("foo-docs-git")
+	ok(t, err)
+	equals(t, revs, got)
+
+	changed, err := Changed(ctx, nil, got)
+	ok(t, err)
+	equals(t, 0, len(changed))
+
+	gitCmd(t, upstream, "commit", "--quiet", "--allow-empty", "-m", "two")
+	changed, err = Changed(ctx, nil, got)
+	ok(t, err)
+	equals(t, []string{sources[0]}, changed)
+
+	_, err = Current(ctx, nil, []string{"git+" + path.Join(dir, "missing")})
+	assert(t, err != nil, "expected an error for a missing repository")
+
+	// Nothing from the PKGBUILD can be taken as an option.
+	pwned := path.Join(dir, "pwned")
+	revs, err = Current(ctx, nil, []string{"foo::git+--upload-pack=touch " + pwned + ";"})
+	ok(t, err)
+	equals(t, Revisions{}, revs)
+	_, err = Head(ctx, nil, Source{Kind: "git", URL: "--upload-pack=touch " + pwned + ";"})
+	assert(t, err != nil, "expected an error for an option as a url")
+	_, err = os.Stat(pwned)
+	assert(t, os.IsNotExist(err), "expected the option not to be run, got %v", err)
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}